@@ -0,0 +1,221 @@
+/** Chat is relayed by the server rather than tunneled through relay packets, so it can be limited and moderated
+
+Messages are sent to one of four channels:
+- match: everyone in the sender's match, spectators included
+- team: everyone on the sender's team in its match
+- whisper: a single client, with a copy to the sender
+- global: every connected client
+
+Every message passes the hub's chat filter, which can be replaced, before it's delivered.
+The last few match channel messages are kept and delivered to clients that join later.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	CHAT_MATCH   = "match"
+	CHAT_TEAM    = "team"
+	CHAT_WHISPER = "whisper"
+	CHAT_GLOBAL  = "global"
+)
+
+type Chat struct {
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+	// UUID of the recipient of a whisper
+	To string `json:"to,omitempty"`
+}
+
+type ChatMessage struct {
+	Channel string            `json:"channel"`
+	From    ClientDescription `json:"from"`
+	To      string            `json:"to,omitempty"`
+	Text    string            `json:"text"`
+	// Unix milliseconds
+	Time int64 `json:"time"`
+}
+
+// ChatFilter inspects a message before it is delivered, returning the text to deliver or an error to reject the message
+type ChatFilter interface {
+	Filter(sender *Client, channel string, text string) (string, error)
+}
+
+// WordListFilter masks every listed word, ignoring case
+type WordListFilter struct {
+	words map[string]bool
+}
+
+func NewWordListFilter(words []string) *WordListFilter {
+	filter := &WordListFilter{words: make(map[string]bool)}
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			filter.words[strings.ToLower(word)] = true
+		}
+	}
+	return filter
+}
+
+// LoadWordListFilter reads a filter from a file with one word per line, an empty path gives a filter that masks nothing
+func LoadWordListFilter(path string) (*WordListFilter, error) {
+	if path == "" {
+		return NewWordListFilter(nil), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		words = append(words, scanner.Text())
+	}
+	return NewWordListFilter(words), scanner.Err()
+}
+
+func (f *WordListFilter) Filter(sender *Client, channel string, text string) (string, error) {
+	if len(f.words) == 0 {
+		return text, nil
+	}
+
+	var filtered strings.Builder
+	var word strings.Builder
+	flush := func() {
+		if f.words[strings.ToLower(word.String())] {
+			filtered.WriteString(strings.Repeat("*", utf8.RuneCountInString(word.String())))
+		} else {
+			filtered.WriteString(word.String())
+		}
+		word.Reset()
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			word.WriteRune(r)
+			continue
+		}
+		flush()
+		filtered.WriteRune(r)
+	}
+	flush()
+	return filtered.String(), nil
+}
+
+// ChatHistory keeps the most recent match channel messages of a match, it belongs to the hub goroutine
+type ChatHistory struct {
+	messages []*Notification
+}
+
+func (c *ChatHistory) Add(message *Notification) {
+	if *chatHistorySize <= 0 {
+		return
+	}
+	c.messages = append(c.messages, message)
+	if len(c.messages) > *chatHistorySize {
+		c.messages = c.messages[len(c.messages)-*chatHistorySize:]
+	}
+}
+
+// SendTo replays the history to a client that just joined
+func (c *ChatHistory) SendTo(client *Client) {
+	for _, message := range c.messages {
+		client.Notify(message)
+	}
+}
+
+func (h *Hub) HandleChat(client *Client, chat Chat) error {
+	if err := h.deliverChat(client, chat); err != nil {
+		log.Printf("Rejected chat from %v: %v", client.username, err)
+		client.SendError(ERR_CHAT_REJECTED, err.Error())
+	}
+	return nil
+}
+
+func (h *Hub) deliverChat(client *Client, chat Chat) error {
+	if !client.chatLimiter.Allow() {
+		return errors.New("sending messages too quickly")
+	}
+	if strings.TrimSpace(chat.Text) == "" {
+		return errors.New("message is empty")
+	}
+	if utf8.RuneCountInString(chat.Text) > *maxChatLength {
+		return fmt.Errorf("message is longer than %d characters", *maxChatLength)
+	}
+
+	text, err := h.chatFilter.Filter(client, chat.Channel, chat.Text)
+	if err != nil {
+		return err
+	}
+
+	message := ChatMessage{
+		Channel: chat.Channel,
+		From:    client.Description(),
+		Text:    text,
+		Time:    time.Now().UnixMilli(),
+	}
+
+	var recipients []*Client
+	match := h.matchByClient[client]
+	if (chat.Channel == CHAT_MATCH || chat.Channel == CHAT_TEAM) && match != nil && match.Mute(client).Chat {
+		return errors.New("muted by the host")
+	}
+	switch chat.Channel {
+	case CHAT_MATCH:
+		if match == nil {
+			return errors.New("not in a match")
+		}
+		recipients = append(match.Clients(), match.Spectators()...)
+	case CHAT_TEAM:
+		team, ok := match.Team(client)
+		if !ok {
+			return errors.New("not on a team")
+		}
+		for _, member := range match.Clients() {
+			if memberTeam, ok := match.Team(member); ok && memberTeam == team {
+				recipients = append(recipients, member)
+			}
+		}
+	case CHAT_WHISPER:
+		uid, err := DecodeUUID(chat.To)
+		if err != nil {
+			return errors.New("whisper recipient is malformed")
+		}
+		recipient := h.clients[uid.String()]
+		if recipient == nil {
+			return errors.New("whisper recipient is not connected")
+		}
+		message.To = chat.To
+		recipients = []*Client{recipient}
+		if recipient != client {
+			recipients = append(recipients, client)
+		}
+	case CHAT_GLOBAL:
+		for _, recipient := range h.clients {
+			recipients = append(recipients, recipient)
+		}
+	default:
+		return fmt.Errorf("unknown chat channel %q", chat.Channel)
+	}
+
+	notify := NewNotification(message, RES_ID_CHAT)
+	if chat.Channel == CHAT_MATCH {
+		match.chatHistory.Add(notify)
+	}
+	for _, recipient := range recipients {
+		recipient.Notify(notify)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// readChat reads up to the next chat message
+func readChat(tb testing.TB, client *testClient) ChatMessage {
+	tb.Helper()
+	var message ChatMessage
+	if err := json.Unmarshal(client.Expect(RES_ID_CHAT)[1:], &message); err != nil {
+		tb.Fatal(err)
+	}
+	return message
+}
+
+func TestChatRateLimit(t *testing.T) {
+	setFlag(t, chatBurst, 2)
+	setFlag(t, chatRate, 0.001)
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	hostAndJoin(t, host)
+
+	for i := 0; i < 2; i++ {
+		host.Command(map[string]any{"action": CHAT, "channel": CHAT_MATCH, "text": "hello"})
+		readChat(t, host)
+	}
+	host.Command(map[string]any{"action": CHAT, "channel": CHAT_MATCH, "text": "hello"})
+	if rejected := host.Expect(RES_ID_ERROR); rejected[1] != ERR_CHAT_REJECTED || string(rejected[2:]) != "sending messages too quickly" {
+		t.Errorf("got %q", rejected)
+	}
+}
+
+func TestChatFilter(t *testing.T) {
+	hub := startHub()
+	hub.chatFilter = NewWordListFilter([]string{"darn"})
+	host := connect(t, hub, "username=host")
+	peer := connect(t, hub, "username=peer")
+	hostAndJoin(t, host, peer)
+
+	host.Command(map[string]any{"action": CHAT, "channel": CHAT_MATCH, "text": "Darn, darned DARN!"})
+	if message := readChat(t, peer); message.Text != "****, darned ****!" {
+		t.Errorf("delivered %q", message.Text)
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	setFlag(t, chatHistorySize, 2)
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	match := hostAndJoin(t, host)
+	for _, text := range []string{"one", "two", "three"} {
+		host.Command(map[string]any{"action": CHAT, "channel": CHAT_MATCH, "text": text})
+		readChat(t, host)
+	}
+
+	// Only the newest messages are kept, and a late joiner gets them oldest first
+	late := connect(t, hub, "username=late")
+	late.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	for _, want := range []string{"two", "three"} {
+		if message := readChat(t, late); message.Text != want || message.From.Username != "host" {
+			t.Errorf("got %q from %v, want %q", message.Text, message.From.Username, want)
+		}
+	}
+}
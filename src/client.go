@@ -1,10 +1,18 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,9 +20,12 @@ const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	sendBufferSize = 256
 )
 
+// errMessageTooLarge is returned by readMessage when a message is over its limit but the connection can stay open
+var errMessageTooLarge = errors.New("message too large")
+
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
@@ -30,12 +41,52 @@ type Client struct {
 	guid     uuid.UUID
 	username string
 	hub      *Hub
-	conn     *websocket.Conn
+	conn     Transport
 	// Buffered channel of outbound messages
 	send chan []byte
+	// Closed once the client is unregistered, senders select on it instead of send being closed
+	done      chan struct{}
+	closeOnce sync.Once
+	// The match the client currently belongs to, relay packets are routed straight to it
+	match atomic.Pointer[Match]
+	// Inbound fragments waiting on the rest of their message
+	fragments *Reassembler
+	// ID of the next outbound fragmented message
+	nextFragmentID atomic.Uint32
+	// Whether permessage-deflate was negotiated for this client
+	compression bool
+	// The protocol version and capabilities negotiated when the client connected, see protocol.go
+	protocol      int
+	batching      bool
+	fragmentation bool
+	// Commands and notification bodies are in JSON, or in CBOR for clients with the cbor capability
+	codec Codec
+	// Limits chat messages and reports, only used from the hub goroutine
+	chatLimiter   *RateLimiter
+	reportLimiter *RateLimiter
+	// The address the client connected from
+	ip string
+	// Reliable relay packets waiting on an ack, carried over when the session is resumed
+	reliable *ReliableOutbox
+	// Token the client resumes its session with, empty when resuming is disabled
+	resumeToken string
+	// The detached client this connection is resuming, only set until the hub registers it
+	resumes *Client
+	// Latest-only packets waiting for the write pump, a newer packet from the same sender and channel replaces the waiting one
+	latestMu    sync.Mutex
+	latest      map[latestKey][]byte
+	latestOrder []latestKey
+	latestReady chan struct{}
+	// Round trip time measured from pings
+	rtt *RTTEstimator
+	// time_sync responses waiting for the write pump to stamp their transmit time
+	timeSyncs chan TimeSyncResponse
+	// Token the client's datagrams start with, and where they last came from, see udp.go
+	udpToken string
+	udpAddr  atomic.Pointer[net.Addr]
 }
 
-func NewClient(username string, hub *Hub, conn *websocket.Conn, send chan []byte) (*Client, error) {
+func NewClient(username string, hub *Hub, conn Transport, send chan []byte) (*Client, error) {
 	log.Println("Creating new client")
 	guid, err := uuid.NewUUID()
 	if err != nil {
@@ -43,13 +94,80 @@ func NewClient(username string, hub *Hub, conn *websocket.Conn, send chan []byte
 		return nil, err
 	}
 
-	return &Client{
-		guid:     guid,
-		username: username,
-		hub:      hub,
-		conn:     conn,
-		send:     send,
-	}, nil
+	client := &Client{
+		guid:          guid,
+		username:      username,
+		hub:           hub,
+		conn:          conn,
+		send:          send,
+		done:          make(chan struct{}),
+		fragments:     NewReassembler(),
+		chatLimiter:   NewRateLimiter(*chatRate, *chatBurst),
+		reportLimiter: NewRateLimiter(reportRate, reportBurst),
+		latest:        make(map[latestKey][]byte),
+		latestReady:   make(chan struct{}, 1),
+		rtt:           NewRTTEstimator(),
+		codec:         JSONCodec,
+		timeSyncs:     make(chan TimeSyncResponse, timeSyncBufferSize),
+	}
+	client.reliable = NewReliableOutbox(client)
+	if *resumeWindow > 0 {
+		client.resumeToken = NewResumeToken()
+	}
+	if hub.udp != nil {
+		client.udpToken = NewUDPToken()
+	}
+	return client, nil
+}
+
+// Send queues a message for the client, it is dropped if the client has already been unregistered
+func (c *Client) Send(message []byte) {
+	if c.fragmentation && len(message) > *fragmentSize {
+		if fragments := Fragment(uint16(c.nextFragmentID.Add(1)), message, *fragmentSize); fragments != nil {
+			for _, fragment := range fragments {
+				c.enqueue(fragment)
+			}
+			return
+		}
+		log.Println("Message has too many fragments, sending it whole")
+	}
+	c.enqueue(message)
+}
+
+// Features returns the FEATURE_ flags negotiated for the client
+func (c *Client) Features() byte {
+	var features byte
+	if c.compression {
+		features |= FEATURE_COMPRESSION
+	}
+	if c.resumeToken != "" {
+		features |= FEATURE_RESUME
+	}
+	if c.udpToken != "" {
+		features |= FEATURE_UDP
+	}
+	if c.batching {
+		features |= FEATURE_BATCHING
+	}
+	if c.codec == CBORCodec {
+		features |= FEATURE_CBOR
+	}
+	if c.fragmentation {
+		features |= FEATURE_FRAGMENTATION
+	}
+	return features
+}
+
+func (c *Client) enqueue(message []byte) {
+	select {
+	case c.send <- message:
+	case <-c.done:
+	}
+}
+
+// Close signals the write pump to shut down, it is safe to call more than once
+func (c *Client) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
 }
 
 func (c *Client) readPump() {
@@ -58,75 +176,256 @@ func (c *Client) readPump() {
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetPongHandler(func(payload []byte) {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.rtt.Pong(payload)
+	})
 	for {
-		_, message, err := c.conn.ReadMessage()
+		message, err := c.readMessage()
+		// Taken before the message waits on the hub, so time_sync doesn't count the wait as network delay
+		received := time.Now()
+		if errors.Is(err, errMessageTooLarge) {
+			log.Println(err)
+			c.SendError(ERR_MESSAGE_TOO_LARGE, err.Error())
+			continue
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			break
 		}
+		if len(message) > 0 && message[0] == FRAGMENT_PREFIX {
+			if !*fragmentation {
+				c.SendError(ERR_BAD_FRAGMENT, "fragmentation is disabled")
+				continue
+			}
+			if message, err = c.fragments.Add(message[1:]); err != nil {
+				log.Println(err)
+				c.SendError(ERR_BAD_FRAGMENT, err.Error())
+				continue
+			}
+			if message == nil {
+				continue
+			}
+		}
+		if len(message) > 0 && message[0] == ACK_PREFIX {
+			if len(message) < 1+reliableSequenceSize {
+				c.SendError(ERR_BAD_COMMAND, "ack is too short to contain a sequence")
+				continue
+			}
+			c.reliable.Ack(binary.LittleEndian.Uint32(message[1:]))
+			continue
+		}
+		// Relay traffic goes straight to the match goroutine so the hub only deals with membership and commands
+		if match := c.match.Load(); match != nil && len(message) > 0 && (message[0] == RELAY_PREFIX || message[0] == RELIABLE_PREFIX || message[0] == LATEST_PREFIX) {
+			match.Relay(message, c)
+			continue
+		}
 		c.hub.broadcast <- struct {
 			RawMessage
 			*Client
-		}{message, c}
+			Received time.Time
+		}{message, c, received}
+	}
+}
+
+// MessageLimit is the largest a message with the prefix may be after the prefix, whichever transport it comes over
+// Relay messages are limited by their payload, so the limit adds the sequence number or channel that comes before it
+func MessageLimit(prefix byte) int {
+	switch prefix {
+	case RELAY_PREFIX:
+		return *maxRelaySize
+	case RELIABLE_PREFIX:
+		return *maxRelaySize + reliableSequenceSize
+	case LATEST_PREFIX:
+		return *maxRelaySize + latestChannelSize
+	case FRAGMENT_PREFIX:
+		return fragmentHeaderSize + *fragmentSize
+	default:
+		return *maxCommandSize
+	}
+}
+
+// readMessage reads the next frame, enforcing the size limit of its prefix without dropping the connection
+func (c *Client) readMessage() ([]byte, error) {
+	r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 1)
+	if _, err := io.ReadFull(r, prefix); err == io.EOF {
+		return []byte{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	limit := MessageLimit(prefix[0])
+	// Reading one byte past the limit tells whether the message is over it, so a message within its limit is read in one go
+	// rather than followed by a drain, which for a compressed message means another pass through the decompressor
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	// Reading past the limit means the message is too large, drain it so the next frame can be read
+	if len(body) > limit {
+		discarded, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %d bytes with prefix %d, limit is %d", errMessageTooLarge, len(body)+int(discarded), prefix[0], limit)
 	}
+
+	return append(prefix, body...), nil
 }
 
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	// Pings keep the connection alive and measure its latency, so they go out often enough for both
+	ticker := time.NewTicker(min(pingPeriod, *rttInterval))
 	defer func() {
 		ticker.Stop()
+		// A failed write leaves nobody draining the send queue, closing unblocks anyone sending to the client
+		c.Close()
 		c.conn.Close()
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.done:
+			// The hub unregistered the client, what it was sent first still goes out, like why it was banned
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			c.drain()
+			c.conn.WriteClose()
+			return
+		case message := <-c.send:
+			if err := c.write(message); err != nil {
 				return
 			}
-
-			w, err := c.conn.NextWriter(websocket.BinaryMessage)
+		case response := <-c.timeSyncs:
+			message, err := c.timeSyncPacket(response, time.Now())
 			if err != nil {
-				return
+				log.Println("Could not marshall the time sync response")
+				continue
 			}
-			w.Write(message)
-
-			if err := w.Close(); err != nil {
+			if err := c.write(message); err != nil {
 				return
 			}
+		case <-c.latestReady:
+			for _, message := range c.takeLatest() {
+				if err := c.write(message); err != nil {
+					return
+				}
+			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := c.conn.Ping(c.rtt.PingPayload()); err != nil {
 				return
 			}
 		}
 	}
 }
 
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	log.Println("Serving the websocket server")
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
+// drain writes the messages already queued for the client, within the write deadline already set
+func (c *Client) drain() {
+	for {
+		select {
+		case message := <-c.send:
+			if err := c.conn.WriteMessage(message); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// write sends one message over the client's transport
+func (c *Client) write(message []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(message)
+}
+
+// connectRequest is a connecting client that passed the checks every transport makes before the client is created
+type connectRequest struct {
+	username    string
+	ip          string
+	negotiation Negotiation
+	// The detached client being resumed, claimed until the request is connected or released
+	resumes *Client
+}
+
+// Refusal is why a connecting client was turned away
+// Websocket clients get the HTTP status, or when there is a close code, are upgraded and sent a close frame with it so browsers can see the reason
+type Refusal struct {
+	Status    int
+	CloseCode int
+	Reason    string
+}
+
+// Admit checks a connecting client's query parameters and bans, and claims the session it resumes
+func (h *Hub) Admit(query url.Values, ip string) (connectRequest, *Refusal) {
+	request := connectRequest{username: query.Get("username"), ip: ip}
+	var refusal *Refusal
+	if request.negotiation, refusal = Negotiate(query); refusal != nil {
+		log.Printf("Refused connection from %v: %v", ip, refusal.Reason)
+		return request, refusal
+	}
+	if request.username == "" {
+		request.username = Generate(1, "_")
 	}
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		username = Generate(1, "_")
+	// A resumed session keeps its GUID and username, and is checked for bans under them
+	if token := query.Get("resume"); token != "" && *resumeWindow > 0 && request.negotiation.Version >= 2 {
+		if request.resumes = h.ClaimSession(token); request.resumes == nil {
+			return request, &Refusal{Status: http.StatusGone, Reason: "Unknown or expired resume token"}
+		}
+		request.username = request.resumes.username
+	}
+	if msg := h.CheckBan(request.username, ip); msg != "" {
+		log.Printf("AUDIT refused connection from %v (%v): %v", request.username, ip, msg)
+		h.Release(request)
+		return request, &Refusal{Status: http.StatusForbidden, Reason: msg}
+	}
+	return request, nil
+}
+
+// Release gives up on a request that won't be connected, a claimed session goes back to waiting out its window
+func (h *Hub) Release(request connectRequest) {
+	if request.resumes != nil {
+		h.unregister <- request.resumes
 	}
-	client, err := NewClient(username, hub, conn, make(chan []byte))
+}
+
+// Connect creates the client for an admitted request on its transport, registers it and starts its pumps
+func (h *Hub) Connect(request connectRequest, conn Transport, compression bool) {
+	client, err := NewClient(request.username, h, conn, make(chan []byte, sendBufferSize))
 	if err != nil {
-		log.Println("Could not open websocket connection, client could not be created")
-		// TODO: Handle response
+		log.Println("Could not open connection, client could not be created")
+		h.Release(request)
+		conn.Close()
 		return
 	}
+	if resumes := request.resumes; resumes != nil {
+		client.guid = resumes.guid
+		client.reliable = resumes.reliable
+		client.resumeToken = resumes.resumeToken
+		client.chatLimiter = resumes.chatLimiter
+		client.reportLimiter = resumes.reportLimiter
+		client.resumes = resumes
+	}
+	client.ip = request.ip
+	client.protocol = request.negotiation.Version
+	// Version 1 clients are never told their tokens, so they can't resume or use UDP
+	if client.protocol < 2 {
+		client.resumeToken = ""
+		client.udpToken = ""
+	}
+	client.batching = request.negotiation.Batching
+	if request.negotiation.CBOR {
+		client.codec = CBORCodec
+	}
+	client.fragmentation = request.negotiation.Fragmentation
+	client.compression = compression
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -134,3 +433,30 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	go client.writePump()
 	go client.readPump()
 }
+
+func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	log.Println("Serving the websocket server")
+	// Banned clients are turned away before they cost an upgrade
+	request, refusal := hub.Admit(r.URL.Query(), RemoteIP(r))
+	if refusal != nil && refusal.CloseCode != 0 {
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(refusal.CloseCode, refusal.Reason), time.Now().Add(writeWait))
+			conn.Close()
+		}
+		return
+	}
+	if refusal != nil {
+		http.Error(w, refusal.Reason, refusal.Status)
+		return
+	}
+
+	counter := &countingResponseWriter{ResponseWriter: w}
+	conn, err := upgrader.Upgrade(counter, r, nil)
+	if err != nil {
+		log.Println(err)
+		hub.Release(request)
+		return
+	}
+	compression := upgrader.EnableCompression && offersCompression(r)
+	hub.Connect(request, NewWebsocketTransport(conn, counter.conn, compression), compression)
+}
@@ -12,9 +12,12 @@ package main
 
 import (
 	"encoding/base64"
-	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
 	"log"
+	"slices"
+	"strings"
+	"time"
 )
 
 const (
@@ -24,11 +27,36 @@ const (
 	LEAVE_MATCH         = "leave_match"
 	LIST_MATCHES        = "list_matches"
 	SET_MATCH_METADATA  = "set_match_metadata"
+	QUEUE_MATCH         = "queue_match"
+	CANCEL_QUEUE        = "cancel_queue"
+	SUBSCRIBE_LOBBY     = "subscribe_lobby"
+	UNSUBSCRIBE_LOBBY   = "unsubscribe_lobby"
+	CREATE_PARTY        = "create_party"
+	INVITE_TO_PARTY     = "invite_to_party"
+	ACCEPT_PARTY_INVITE = "accept_party_invite"
+	LEAVE_PARTY         = "leave_party"
+	CHAT                = "chat"
+	SPECTATE_MATCH      = "spectate_match"
+	REPLAY_MATCH        = "replay_match"
+	KICK_PEER           = "kick_peer"
+	BAN_PEER            = "ban_peer"
+	UNBAN_PEER          = "unban_peer"
+	MUTE_PEER           = "mute_peer"
+	LOCK_MATCH          = "lock_match"
+	REPORT_PLAYER       = "report_player"
+	SET_STATE           = "set_state"
+	DELETE_STATE        = "delete_state"
+	GET_PEER_STATS      = "get_peer_stats"
+	TIME_SYNC           = "time_sync"
+	SIGNAL              = "signal"
 )
 
+// defaultMaxClients is the size of a hosted match
+const defaultMaxClients = 4
+
 type ServerCommand struct {
 	Action string `json:"action"`
-	Inputs json.RawMessage
+	Inputs Value
 }
 
 type SetPlayerMetadata struct {
@@ -36,217 +64,674 @@ type SetPlayerMetadata struct {
 }
 
 type HostMatch struct {
-	Name string `json:"name"`
+	Name       string            `json:"name"`
+	Region     string            `json:"region"`
+	Tags       []string          `json:"tags"`
+	Properties map[string]string `json:"properties"`
+	// Record the match's relayed traffic for replaying later, ignored if the server isn't recording
+	Record bool `json:"record"`
+	// Batch relay packets into one frame per player this many times a second, 0 sends each packet as it comes
+	TickRate int `json:"tick_rate"`
 }
 
+// SetMatchMetadata changes the metadata of a match, only the host may send it and omitted fields are left as they are
 type SetMatchMetadata struct {
-	UUID string `json:"uuid"`
-	Name string `json:"name"`
+	UUID       string             `json:"uuid"`
+	Name       *string            `json:"name"`
+	State      *string            `json:"state"`
+	Region     *string            `json:"region"`
+	Tags       *[]string          `json:"tags"`
+	Properties *map[string]string `json:"properties"`
 }
 
+// JoinMatch identifies the match to join by exactly one of its UUID, invite code or name
+// Match is for free text entry and is tried as each of those in turn
 type JoinMatch struct {
-	UUID string `json:"uuid"`
+	UUID  string `json:"uuid"`
+	Code  string `json:"code"`
+	Name  string `json:"name"`
+	Match string `json:"match"`
 }
 
+// AmbiguousMatch is sent when a name is shared by several matches, so the client can pick one by UUID
+type AmbiguousMatch struct {
+	Message    string             `json:"message"`
+	Candidates []MatchDescription `json:"candidates"`
+}
+
+// LeaveMatch takes the client out of the match it plays or spectates in, the UUID must name that match when it is given
 type LeaveMatch struct {
 	UUID string `json:"uuid"`
 }
 
+// QueueMatch puts the client in the matchmaking queue
+type QueueMatch struct {
+	GameMode string `json:"game_mode"`
+	Region   string `json:"region"`
+	// The number of players in the match, split evenly between the teams
+	MatchSize int      `json:"match_size"`
+	Teams     int      `json:"teams,omitempty"`
+	Rating    *float64 `json:"rating,omitempty"`
+	// Seconds to wait before giving up, capped by the server's queue timeout
+	Timeout int `json:"timeout,omitempty"`
+}
+
 type ClientDescription struct {
 	Username string `json:"username"`
 	UUID     string `json:"uuid"`
+	// Only in peer notifications and stats, once the client's latency has been measured
+	Latency *Latency `json:"latency,omitempty"`
+	// Only in peer notifications and stats, for players
+	PeerID int32 `json:"peer_id,omitempty"`
 }
 
-type MatchDescription struct {
-	Name string `json:"name"`
-	Guid string `json:"guid"`
+func (c *Client) Description() ClientDescription {
+	return ClientDescription{Username: c.username, UUID: base64.StdEncoding.EncodeToString(c.guid[:])}
 }
 
-// ListMatches
-// Todo: Do we want to filter anything on the server side vs the client side?
-type ListMatches struct{}
+type MatchDescription struct {
+	Name       string `json:"name"`
+	Code       string `json:"code"`
+	Guid       string `json:"guid"`
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"max_players"`
+	// Spectators don't count toward the players
+	Spectators    int `json:"spectators"`
+	MaxSpectators int `json:"max_spectators"`
+	// Username of the host, omitted for replays
+	Host       string            `json:"host,omitempty"`
+	State      string            `json:"state"`
+	Region     string            `json:"region,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	// Unix seconds
+	Created   int64 `json:"created"`
+	Recording bool  `json:"recording,omitempty"`
+	// Locked matches take no new players or spectators
+	Locked bool `json:"locked,omitempty"`
+	// Batches of relay packets a second, omitted when relay packets aren't batched
+	TickRate int `json:"tick_rate,omitempty"`
+	// Replays are only shown to their spectators, see replay.go
+	Replay bool `json:"replay,omitempty"`
+}
 
-func (h *Hub) HandleServerCommand(client *Client, jsonData []byte) error {
-	log.Println("Handling Server Command...")
-	//var action ServerCommand
-	var obj map[string]json.RawMessage
+// ListMatches filters, sorts and pages the lobby, every filter is optional
+type ListMatches struct {
+	// Case insensitive substring of the match name
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Region string `json:"region"`
+	// Only list matches another player could join, so not full or locked ones
+	HasSlots bool `json:"has_slots"`
+	// Matches must carry every tag and every property
+	Tags       []string          `json:"tags"`
+	Properties map[string]string `json:"properties"`
+
+	// One of players, created or name, defaults to created
+	SortBy     string `json:"sort_by"`
+	Descending bool   `json:"descending"`
+
+	// The next_cursor of the previous page, empty for the first page
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
 
-	if err := json.Unmarshal(jsonData, &obj); err != nil {
-		return err
-	}
+type MatchListing struct {
+	Matches []MatchDescription `json:"matches"`
+	// Omitted on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
 
-	var action string
-	if err := json.Unmarshal(obj["action"], &action); err != nil {
+// HandleServerCommand decodes the command in the client's codec, first for its action and then into the action's struct
+func (h *Hub) HandleServerCommand(client *Client, data []byte, received time.Time) error {
+	log.Println("Handling Server Command...")
+	var command ServerCommand
+	if err := client.codec.Unmarshal(data, &command); err != nil {
+		client.SendError(ERR_BAD_COMMAND, "Malformed command: "+err.Error())
 		return err
 	}
+	action := command.Action
 
 	log.Println("Unmarshalled Command...")
 
 	switch action {
 	case SET_PLAYER_METADATA:
-		return h.HandleSetPlayerMetadata(client, jsonData)
+		return h.HandleSetPlayerMetadata(client, data)
 	case HOST_MATCH:
-		var name string
-		json.Unmarshal(obj["name"], &name)
-		return h.HandleHostMatch(client, HostMatch{Name: name})
+		var message HostMatch
+		client.codec.Unmarshal(data, &message)
+		return h.HandleHostMatch(client, message)
 	case JOIN_MATCH:
-		var uid string
-		json.Unmarshal(obj["uuid"], &uid)
-		return h.HandleJoinMatch(client, JoinMatch{UUID: uid})
+		var message JoinMatch
+		client.codec.Unmarshal(data, &message)
+		return h.HandleJoinMatch(client, message)
 	case LIST_MATCHES:
-		return h.HandleListMatches(client)
+		var query ListMatches
+		if err := client.codec.Unmarshal(data, &query); err != nil {
+			return err
+		}
+		return h.HandleListMatches(client, query)
 	case LEAVE_MATCH:
-		var uid string
-		json.Unmarshal(obj["uuid"], &uid)
-		return h.HandleLeaveMatch(client, LeaveMatch{UUID: uid})
+		var message LeaveMatch
+		client.codec.Unmarshal(data, &message)
+		return h.HandleLeaveMatch(client, message)
 	case SET_MATCH_METADATA:
-		return h.HandleSetMatchMetadata(client, jsonData)
+		var message SetMatchMetadata
+		if err := client.codec.Unmarshal(data, &message); err != nil {
+			return err
+		}
+		return h.HandleSetMatchMetadata(client, message)
+	case QUEUE_MATCH:
+		var criteria QueueMatch
+		if err := client.codec.Unmarshal(data, &criteria); err != nil {
+			return err
+		}
+		return h.HandleQueueMatch(client, criteria)
+	case CANCEL_QUEUE:
+		h.matchmaker.Cancel(client)
+		return nil
+	case SUBSCRIBE_LOBBY:
+		var query ListMatches
+		if err := client.codec.Unmarshal(data, &query); err != nil {
+			return err
+		}
+		return h.HandleSubscribeLobby(client, query)
+	case UNSUBSCRIBE_LOBBY:
+		delete(h.subscriptions, client)
+		return nil
+	case CREATE_PARTY:
+		return h.HandleCreateParty(client)
+	case INVITE_TO_PARTY:
+		var message InviteToParty
+		client.codec.Unmarshal(data, &message)
+		return h.HandleInviteToParty(client, message)
+	case ACCEPT_PARTY_INVITE:
+		var message AcceptPartyInvite
+		client.codec.Unmarshal(data, &message)
+		return h.HandleAcceptPartyInvite(client, message)
+	case LEAVE_PARTY:
+		h.LeaveParty(client)
+		return nil
+	case CHAT:
+		var message Chat
+		client.codec.Unmarshal(data, &message)
+		return h.HandleChat(client, message)
+	case SPECTATE_MATCH:
+		var message JoinMatch
+		client.codec.Unmarshal(data, &message)
+		return h.HandleSpectateMatch(client, message)
+	case REPLAY_MATCH:
+		var message ReplayMatch
+		client.codec.Unmarshal(data, &message)
+		return h.HandleReplayMatch(client, message)
+	case KICK_PEER, BAN_PEER, UNBAN_PEER:
+		var message KickPeer
+		client.codec.Unmarshal(data, &message)
+		return h.HandleKickPeer(client, action, message)
+	case MUTE_PEER:
+		var message MutePeer
+		client.codec.Unmarshal(data, &message)
+		return h.HandleMutePeer(client, message)
+	case LOCK_MATCH:
+		var message LockMatch
+		client.codec.Unmarshal(data, &message)
+		return h.HandleLockMatch(client, message)
+	case REPORT_PLAYER:
+		var message ReportPlayer
+		client.codec.Unmarshal(data, &message)
+		return h.HandleReportPlayer(client, message)
+	case SET_STATE:
+		var message SetState
+		if err := client.codec.Unmarshal(data, &message); err != nil {
+			return err
+		}
+		return h.HandleSetState(client, message)
+	case DELETE_STATE:
+		var message DeleteState
+		if err := client.codec.Unmarshal(data, &message); err != nil {
+			return err
+		}
+		return h.HandleDeleteState(client, message)
+	case GET_PEER_STATS:
+		var message GetPeerStats
+		client.codec.Unmarshal(data, &message)
+		return h.HandleGetPeerStats(client, message)
+	case TIME_SYNC:
+		var message TimeSync
+		if err := client.codec.Unmarshal(data, &message); err != nil {
+			return err
+		}
+		return h.HandleTimeSync(client, message, received)
+	case SIGNAL:
+		var message Signal
+		if err := client.codec.Unmarshal(data, &message); err != nil {
+			return err
+		}
+		return h.HandleSignal(client, message)
 	default:
 		return nil
 	}
 }
 
-func (h *Hub) HandleSetPlayerMetadata(client *Client, jsonData []byte) error {
+func (h *Hub) HandleSetPlayerMetadata(client *Client, data []byte) error {
 	return nil
 }
 
 func (h *Hub) HandleHostMatch(client *Client, message HostMatch) error {
 	log.Println("Host match requested...")
 
-	guid, err := uuid.NewUUID()
+	members, err := h.PartyMembers(client)
+	if err != nil {
+		client.SendError(ERR_BAD_COMMAND, err.Error())
+		return nil
+	}
+	if message.TickRate < 0 || message.TickRate > *maxTickRate {
+		client.SendError(ERR_BAD_COMMAND, fmt.Sprintf("Tick rate must be 0 to %d", *maxTickRate))
+		return nil
+	}
+
+	match, err := h.CreateMatch(client, MatchData{
+		Name:       message.Name,
+		Region:     message.Region,
+		Tags:       message.Tags,
+		Properties: message.Properties,
+		Recording:  message.Record,
+		TickRate:   message.TickRate,
+	}, max(defaultMaxClients, len(members)))
 	if err != nil {
-		log.Println("Could not create UUID for new match")
 		return err
 	}
 
-	log.Printf("HANDLING GUID %s", guid.String())
+	// Tell the host the name and invite code to share with other players
+	client.Notify(NewNotification(match.Description(), RES_ID_CONFIRMATION, CONF_HOSTED_MATCH))
 
-	var name = message.Name
-	if name == "" {
-		name = Generate(2, "_")
+	// The rest of the party joins the host
+	if len(members) > 1 {
+		if _, err := h.AddToMatch(match, members[1:]...); err != nil {
+			return err
+		}
+		for _, member := range members[1:] {
+			h.SendJoinConfirmation(member)
+			if err := h.AnnouncePeer(member, match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateMatch starts a new match hosted by the client, taking the host out of any match it was already in
+func (h *Hub) CreateMatch(host *Client, meta MatchData, maxClients int) (*Match, error) {
+	meta, err := h.NewMatchData(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	h.RemoveFromMatch(host)
+	h.matchmaker.Cancel(host)
+	if meta.Recording && *recordDir == "" {
+		log.Println("Recording is disabled on this server, hosting without it")
+		meta.Recording = false
+	}
+	match := NewMatch(meta, host, maxClients)
+	if meta.Recording {
+		h.StartRecording(match)
 	}
 
-	clients := make(map[string]*Client)
-	clients[client.guid.String()] = client
+	h.StartMatch(match, host)
+	return match, nil
+}
 
-	meta := MatchData{
-		Guid: guid,
-		Name: name,
+// NewMatchData fills in the parts of a new match's metadata the server decides
+func (h *Hub) NewMatchData(meta MatchData) (MatchData, error) {
+	guid, err := uuid.NewUUID()
+	if err != nil {
+		log.Println("Could not create UUID for new match")
+		return meta, err
 	}
 
-	match := &Match{
-		meta:       meta,
-		host:       client,
-		clients:    clients,
-		maxClients: 4, // TODO: We can parameterize this
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan []byte),
-		end:        make(chan bool),
+	log.Printf("HANDLING GUID %s", guid.String())
+
+	if meta.Name == "" {
+		meta.Name = Generate(2, "_")
 	}
+	meta.Guid = guid
+	meta.Code = h.NewInviteCode()
+	meta.State = NotReady
+	meta.Created = time.Now()
+	return meta, nil
+}
 
-	h.matches[guid.String()] = match
+// StartMatch makes the match known with the client in it and starts the match goroutine, so the match must be set up by then
+func (h *Hub) StartMatch(match *Match, client *Client) {
+	h.matches[match.meta.Guid.String()] = match
+	h.IndexMatch(match)
 	h.matchByClient[client] = match
+	client.match.Store(match)
+	delete(h.subscriptions, client)
+	h.LobbyChanged(match)
 
 	go match.run()
-
-	return nil
 }
 
 func (h *Hub) HandleJoinMatch(client *Client, match JoinMatch) error {
 	log.Println("Join match requested...")
 
-	log.Printf("Base64 string to decode %s", match.UUID)
-
-	decodedIDBytes, err := base64.StdEncoding.DecodeString(match.UUID)
+	candidates, err := h.ResolveMatch(match)
 	if err != nil {
-		log.Println("Error decoding UUID")
 		return err
 	}
 
-	uid, err := uuid.FromBytes(decodedIDBytes)
-	if err != nil {
-		log.Println("Error parsing decoded bytes")
-		return err
+	if len(candidates) > 1 {
+		return SendAmbiguousMatch(client, candidates)
 	}
 
-	log.Printf("HANDLING GUID %s", uid.String())
-	matchObj := h.matches[uid.String()]
+	var matchObj *Match
+	if len(candidates) == 1 {
+		matchObj = candidates[0]
+	}
 
 	if matchObj == nil {
 		msg := "Match does not exist"
 		log.Println(msg)
 		response := []byte{CONF_FAILED_JOIN}
 		response = append(response, []byte(msg)...)
-		client.send <- response
+		client.Send(response)
+		return nil
+	}
+
+	if matchObj.Client(client.guid.String()) != nil {
+		msg := "Already in match"
+		log.Println(msg)
+		response := []byte{CONF_FAILED_JOIN}
+		response = append(response, []byte(msg)...)
+		client.Send(response)
+		return nil
+	}
+
+	members, err := h.PartyMembers(client)
+	if err != nil {
+		msg := "Only the party leader can join a match"
+		log.Println(msg)
+		response := []byte{CONF_FAILED_JOIN}
+		response = append(response, []byte(msg)...)
+		client.Send(response)
+		return nil
+	}
+	// Party members already playing in the match stay where they are
+	members = slices.DeleteFunc(members, func(member *Client) bool { return matchObj.Client(member.guid.String()) != nil })
+
+	if msg := matchObj.Refuses(members); msg != "" {
+		log.Println(msg)
+		response := []byte{CONF_FAILED_JOIN}
+		response = append(response, []byte(msg)...)
+		client.Send(response)
 		return nil
 	}
 
-	if len(matchObj.clients) == matchObj.maxClients {
+	if joined, err := h.AddToMatch(matchObj, members...); err != nil {
+		return err
+	} else if !joined {
 		msg := "Max clients reached"
+		if len(members) > 1 {
+			msg = "Not enough room for the whole party"
+		}
 		log.Println(msg)
 		response := []byte{CONF_FAILED_JOIN}
 		response = append(response, []byte(msg)...)
-		client.send <- response
+		client.Send(response)
 		return nil
 	}
 
-	for _, existingClient := range matchObj.clients {
-		if packet, err := json.Marshal(ClientDescription{Username: existingClient.username, UUID: base64.StdEncoding.EncodeToString(existingClient.guid[:])}); err != nil {
-			log.Println("Could not marshall the client description")
+	for _, member := range members {
+		h.SendJoinConfirmation(member)
+		if err := h.AnnouncePeer(member, matchObj); err != nil {
 			return err
-		} else {
-			notify := []byte{RES_ID_PEER_CONNECTED}
-			notify = append(notify, packet...)
-			client.send <- notify
 		}
 	}
+	return nil
+}
 
-	matchObj.clients[client.guid.String()] = client
-	h.matchByClient[client] = matchObj
-
+func (h *Hub) SendJoinConfirmation(client *Client) {
 	msg := "Match successfully joined"
 	response := []byte{CONF_JOIN_MATCH}
 	response = append(response, []byte(msg)...)
-	client.send <- response
+	client.Send(response)
+}
 
-	if packet, err := json.Marshal(ClientDescription{Username: client.username, UUID: base64.StdEncoding.EncodeToString(client.guid[:])}); err != nil {
-		log.Println("Could not marshall the client description")
-		return err
-	} else {
-		notify := []byte{RES_ID_PEER_CONNECTED}
-		notify = append(notify, packet...)
-		matchObj.broadcast <- notify
+// SendAmbiguousMatch lists the matches sharing a name so the client can pick one by UUID
+func SendAmbiguousMatch(client *Client, candidates []*Match) error {
+	ambiguous := AmbiguousMatch{
+		Message:    "More than one match has that name",
+		Candidates: make([]MatchDescription, 0, len(candidates)),
 	}
+	for _, candidate := range candidates {
+		ambiguous.Candidates = append(ambiguous.Candidates, candidate.Description())
+	}
+	log.Println(ambiguous.Message)
+	client.Notify(NewNotification(ambiguous, RES_ID_ERROR, ERR_AMBIGUOUS_MATCH))
 	return nil
 }
 
-func (h *Hub) HandleLeaveMatch(client *Client, match LeaveMatch) error {
+// ResolveMatch finds the matches the join request could refer to, more than one means the name was ambiguous
+// Candidates are ordered oldest first, ties broken by GUID, so the same request always lists them the same way
+func (h *Hub) ResolveMatch(join JoinMatch) ([]*Match, error) {
+	var candidates []*Match
+	switch {
+	case join.UUID != "":
+		log.Printf("Base64 string to decode %s", join.UUID)
+		uid, err := DecodeUUID(join.UUID)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("HANDLING GUID %s", uid.String())
+		if match := h.matches[uid.String()]; match != nil {
+			candidates = []*Match{match}
+		}
+	case join.Code != "":
+		if match := h.FindMatchByCode(join.Code); match != nil {
+			candidates = []*Match{match}
+		}
+	case join.Name != "":
+		candidates = h.FindMatchByName(join.Name)
+	case join.Match != "":
+		if uid, err := DecodeUUID(join.Match); err == nil && h.matches[uid.String()] != nil {
+			candidates = []*Match{h.matches[uid.String()]}
+		} else if match := h.FindMatchByCode(join.Match); match != nil {
+			candidates = []*Match{match}
+		} else {
+			candidates = h.FindMatchByName(join.Match)
+		}
+	}
+
+	candidates = slices.Clone(candidates)
+	slices.SortFunc(candidates, func(a, b *Match) int {
+		if compared := a.meta.Created.Compare(b.meta.Created); compared != 0 {
+			return compared
+		}
+		return strings.Compare(a.meta.Guid.String(), b.meta.Guid.String())
+	})
+	return candidates, nil
+}
+
+// AddToMatch moves the clients into the match together and tells each about the peers already there
+// Returns false if the match lacks room for all of them, in which case none of them join
+func (h *Hub) AddToMatch(match *Match, clients ...*Client) (bool, error) {
+	existingClients := match.Clients()
+	if !match.AddClients(clients) {
+		return false, nil
+	}
+
+	for _, client := range clients {
+		if h.matchByClient[client] == match {
+			// A spectator taking a seat in the match it was watching
+			match.RemoveSpectator(client)
+		} else {
+			h.RemoveFromMatch(client)
+		}
+		h.matchmaker.Cancel(client)
+		h.matchByClient[client] = match
+		client.match.Store(match)
+		delete(h.subscriptions, client)
+	}
+	h.LobbyChanged(match)
+
+	// Each client hears about the clients ahead of it, the same as if they had joined one after another
+	for _, client := range clients {
+		for _, existingClient := range existingClients {
+			client.Notify(NewNotification(existingClient.PeerDescription(), RES_ID_PEER_CONNECTED))
+		}
+		existingClients = append(existingClients, client)
+		match.chatHistory.SendTo(client)
+		if err := SendStateSnapshot(match, client); err != nil {
+			return true, err
+		}
+		RecordPeer(match, RECORD_JOIN, client)
+	}
+	return true, nil
+}
+
+// AnnouncePeer tells every member of the match, the client included, that the client has connected
+func (h *Hub) AnnouncePeer(client *Client, match *Match) error {
+	match.Broadcast(NewNotification(client.PeerDescription(), RES_ID_PEER_CONNECTED))
 	return nil
 }
 
-func (h *Hub) HandleListMatches(client *Client) error {
+func (h *Hub) HandleLeaveMatch(client *Client, message LeaveMatch) error {
+	log.Println("Leave match requested...")
+
+	match := h.matchByClient[client]
+	if match != nil && message.UUID != "" {
+		uid, err := DecodeUUID(message.UUID)
+		if err != nil {
+			return err
+		}
+		if uid != match.meta.Guid {
+			match = nil
+		}
+	}
+	if match == nil {
+		msg := "Not in that match"
+		log.Println(msg)
+		client.SendError(ERR_BAD_COMMAND, msg)
+		return nil
+	}
+
+	h.RemoveFromMatch(client)
+	client.Notify(NewNotification(Removal{
+		Match: base64.StdEncoding.EncodeToString(match.meta.Guid[:]),
+	}, RES_ID_CONFIRMATION, CONF_LEFT_MATCH))
+	return nil
+}
+
+func (h *Hub) HandleListMatches(client *Client, query ListMatches) error {
 	log.Println("List matches requested...")
-	matchListing := make([]MatchDescription, 0)
-	for guid := range h.matches {
-		match := h.matches[guid]
-		matchData := match.meta
-		matchListing = append(matchListing, MatchDescription{Name: matchData.Name, Guid: base64.StdEncoding.EncodeToString(matchData.Guid[:])})
-	}
-	if packet, err := json.Marshal(matchListing); err != nil {
-		log.Println("Could not marshall match listing")
-		return err
-	} else {
-		log.Println("Sending response back to client")
-		// Send the listing as data to just the client with the proper identifier byte prefix
-		response := []byte{RES_ID_COMMAND_RES}
-		response = append(response, packet...)
-		client.send <- response
+	matchListing, err := h.ListMatches(query)
+	if err != nil {
+		log.Println(err)
+		client.SendError(ERR_BAD_COMMAND, err.Error())
+		return nil
 	}
+	log.Println("Sending response back to client")
+	// Send the listing as data to just the client with the proper identifier byte prefix
+	client.Notify(NewNotification(matchListing, RES_ID_COMMAND_RES))
 
 	return nil
 }
 
-func (h *Hub) HandleSetMatchMetadata(client *Client, jsonData []byte) error {
+func (h *Hub) HandleQueueMatch(client *Client, criteria QueueMatch) error {
+	log.Println("Queue match requested...")
+
+	if criteria.MatchSize == 0 {
+		criteria.MatchSize = defaultMaxClients
+	}
+	if criteria.Teams == 0 {
+		criteria.Teams = 1
+	}
+
+	members, err := h.PartyMembers(client)
+	var msg string
+	if err != nil {
+		msg = "Only the party leader can queue"
+	} else if criteria.MatchSize < 2 || criteria.MatchSize > *maxMatchSize {
+		msg = fmt.Sprintf("Match size must be between 2 and %d", *maxMatchSize)
+	} else if criteria.Teams < 1 || criteria.MatchSize%criteria.Teams != 0 {
+		msg = "Match size must divide evenly into teams"
+	} else if len(members) > criteria.MatchSize/criteria.Teams {
+		msg = "The party doesn't fit on one team"
+	}
+	if msg != "" {
+		log.Println(msg)
+		response := []byte{RES_ID_CONFIRMATION, CONF_FAILED_QUEUE}
+		response = append(response, []byte(msg)...)
+		client.Send(response)
+		return nil
+	}
+
+	h.matchmaker.Queue(members, criteria)
 	return nil
 }
+
+func (h *Hub) HandleSetMatchMetadata(client *Client, message SetMatchMetadata) error {
+	log.Println("Set match metadata requested...")
+
+	uid, err := DecodeUUID(message.UUID)
+	if err != nil {
+		return err
+	}
+
+	match := h.matches[uid.String()]
+	var msg string
+	if match == nil {
+		msg = "Match does not exist"
+	} else if match.host != client {
+		msg = "Only the host can change match metadata"
+	} else if message.State != nil && !slices.Contains([]string{NotReady, READY, ACTIVE, ENDED}, *message.State) {
+		msg = fmt.Sprintf("Unknown match state %q", *message.State)
+	}
+	if msg != "" {
+		log.Println(msg)
+		client.SendError(ERR_BAD_COMMAND, msg)
+		return nil
+	}
+
+	// The match goroutine reads the metadata, so it is changed under the lock and re-indexed around it
+	h.UnindexMatch(match)
+	match.mu.Lock()
+	if message.Name != nil && *message.Name != "" {
+		match.meta.Name = *message.Name
+	}
+	if message.State != nil {
+		match.meta.State = *message.State
+	}
+	if message.Region != nil {
+		match.meta.Region = *message.Region
+	}
+	if message.Tags != nil {
+		match.meta.Tags = *message.Tags
+	}
+	if message.Properties != nil {
+		match.meta.Properties = *message.Properties
+	}
+	match.mu.Unlock()
+	h.IndexMatch(match)
+	RecordMetadata(match)
+	h.LobbyChanged(match)
+	return nil
+}
+
+// DecodeUUID parses the base64 encoded UUIDs clients use to refer to matches and peers
+func DecodeUUID(encoded string) (uuid.UUID, error) {
+	decodedIDBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Println("Error decoding UUID")
+		return uuid.Nil, err
+	}
+
+	uid, err := uuid.FromBytes(decodedIDBytes)
+	if err != nil {
+		log.Println("Error parsing decoded bytes")
+		return uuid.Nil, err
+	}
+	return uid, nil
+}
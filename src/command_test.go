@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLeaveMatch(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	peer := connect(t, hub, "username=peer")
+	spectator := connect(t, hub, "username=spectator")
+	match := hostAndJoin(t, host, peer)
+	spectator.Command(map[string]any{"action": SPECTATE_MATCH, "uuid": match})
+	spectator.Expect(RES_ID_CONFIRMATION)
+	host.Expect(RES_ID_SPECTATOR_CONNECTED)
+
+	spectator.Command(map[string]any{"action": LEAVE_MATCH, "uuid": match})
+	if left := spectator.Expect(RES_ID_CONFIRMATION); left[1] != CONF_LEFT_MATCH {
+		t.Errorf("spectator got %q leaving", left)
+	}
+	host.Expect(RES_ID_SPECTATOR_DISCONNECTED)
+
+	peer.Command(map[string]any{"action": LEAVE_MATCH, "uuid": match})
+	if left := peer.Expect(RES_ID_CONFIRMATION); left[1] != CONF_LEFT_MATCH {
+		t.Errorf("peer got %q leaving", left)
+	}
+	host.Expect(RES_ID_PEER_DISCONNECTED)
+
+	// Having left, the peer is no longer in a match to leave, and can join again
+	peer.Command(map[string]any{"action": LEAVE_MATCH})
+	if rejected := peer.Expect(RES_ID_ERROR); string(rejected[2:]) != "Not in that match" {
+		t.Errorf("got %q leaving twice", rejected)
+	}
+	peer.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	host.Expect(RES_ID_PEER_CONNECTED)
+
+	// The last player leaving ends the match
+	peer.Command(map[string]any{"action": LEAVE_MATCH})
+	host.Expect(RES_ID_PEER_DISCONNECTED)
+	host.Command(map[string]any{"action": LEAVE_MATCH, "uuid": match})
+	host.Expect(RES_ID_CONFIRMATION)
+	peer.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	if refused := peer.Expect(CONF_FAILED_JOIN); string(refused[1:]) != "Match does not exist" {
+		t.Errorf("got %q joining an ended match", refused)
+	}
+}
+
+func TestJoinByNameOrCode(t *testing.T) {
+	hub := startHub()
+	var hosted []MatchDescription
+	for _, name := range []string{"Castle Arena", "castle_arena", "Dungeon"} {
+		host := connect(t, hub, "username=host")
+		host.Command(map[string]any{"action": HOST_MATCH, "name": name})
+		var description MatchDescription
+		if err := json.Unmarshal(host.Expect(RES_ID_CONFIRMATION)[2:], &description); err != nil {
+			t.Fatal(err)
+		}
+		hosted = append(hosted, description)
+	}
+
+	t.Run("ambiguous name", func(t *testing.T) {
+		client := connect(t, hub, "username=joiner")
+		client.Command(map[string]any{"action": JOIN_MATCH, "name": "CASTLE-ARENA"})
+		rejected := client.Expect(RES_ID_ERROR)
+		if rejected[1] != ERR_AMBIGUOUS_MATCH {
+			t.Fatalf("got %q", rejected)
+		}
+		var ambiguous AmbiguousMatch
+		if err := json.Unmarshal(rejected[2:], &ambiguous); err != nil {
+			t.Fatal(err)
+		}
+		// Oldest first
+		if len(ambiguous.Candidates) != 2 || ambiguous.Candidates[0].Guid != hosted[0].Guid || ambiguous.Candidates[1].Guid != hosted[1].Guid {
+			t.Errorf("candidates %+v", ambiguous.Candidates)
+		}
+	})
+	tests := []struct {
+		name string
+		join map[string]any
+		want string
+	}{
+		{"code", map[string]any{"code": " " + strings.ToLower(hosted[0].Code)}, hosted[0].Guid},
+		{"unique name", map[string]any{"name": "dungeon"}, hosted[2].Guid},
+		{"free text code", map[string]any{"match": hosted[1].Code}, hosted[1].Guid},
+		{"free text name", map[string]any{"match": "Dungeon"}, hosted[2].Guid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := connect(t, hub, "username=joiner")
+			test.join["action"] = JOIN_MATCH
+			client.Command(test.join)
+			client.Expect(RES_ID_PEER_CONNECTED)
+			// Leaving by UUID only works for the match the client is in
+			client.Command(map[string]any{"action": LEAVE_MATCH, "uuid": test.want})
+			for {
+				message := client.Read()
+				if message[0] == RES_ID_ERROR {
+					t.Fatalf("joined another match than %v: %q", test.want, message)
+				}
+				if message[0] == RES_ID_CONFIRMATION && message[1] == CONF_LEFT_MATCH {
+					break
+				}
+			}
+		})
+	}
+	t.Run("unknown name", func(t *testing.T) {
+		client := connect(t, hub, "username=joiner")
+		client.Command(map[string]any{"action": JOIN_MATCH, "name": "castle"})
+		if refused := client.Expect(CONF_FAILED_JOIN); string(refused[1:]) != "Match does not exist" {
+			t.Errorf("got %q", refused)
+		}
+	})
+}
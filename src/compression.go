@@ -0,0 +1,73 @@
+/** Per message compression (permessage-deflate)
+
+Compression is negotiated per client by the websocket handshake, messages under the threshold are sent uncompressed.
+Bytes saved are published with the rest of the expvar metrics under /admin/vars.
+*/
+
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	compressedBytesIn  = expvar.NewInt("compression_bytes_in")
+	compressedBytesOut = expvar.NewInt("compression_bytes_out")
+	compressionSaved   = expvar.NewInt("compression_bytes_saved")
+)
+
+// countingConn counts the bytes written to the wire so compressed message sizes can be measured
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter hands the upgrader a countingConn when the connection is hijacked
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, brw, nil
+}
+
+// offersCompression mirrors the upgrader's negotiation, which accepts any permessage-deflate offer
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordCompression tracks how many bytes a compressed message took on the wire
+func recordCompression(size int, wire int64) {
+	compressedBytesIn.Add(int64(size))
+	compressedBytesOut.Add(wire)
+	compressionSaved.Add(int64(size) - wire)
+}
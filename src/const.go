@@ -13,6 +13,40 @@ const (
 	RES_ID_CONFIRMATION      = byte(2)
 	RES_ID_PEER_CONNECTED    = byte(3)
 	RES_ID_PEER_DISCONNECTED = byte(4)
+	RES_ID_ERROR             = byte(5)
+	RES_ID_FRAGMENT          = byte(6)
+	RES_ID_LOBBY_UPDATE      = byte(7)
+	RES_ID_PARTY_UPDATE      = byte(8)
+	RES_ID_PARTY_INVITE      = byte(9)
+	RES_ID_CHAT              = byte(10)
+	// Spectators are announced apart from players
+	RES_ID_SPECTATOR_CONNECTED    = byte(11)
+	RES_ID_SPECTATOR_DISCONNECTED = byte(12)
+	// Replays
+	RES_ID_REPLAY_RELAY    = byte(13)
+	RES_ID_REPLAY_METADATA = byte(14)
+	// Host controls
+	RES_ID_KICKED = byte(15)
+	RES_ID_BANNED = byte(16)
+	// Match state
+	RES_ID_STATE_UPDATE   = byte(17)
+	RES_ID_STATE_SNAPSHOT = byte(18)
+	// Reliable relay packets
+	RES_ID_RELIABLE_MSG = byte(19)
+	RES_ID_RECEIPT      = byte(20)
+	// Latest-only relay packets
+	RES_ID_LATEST_MSG = byte(21)
+	// Relay packets batched by a ticking match
+	RES_ID_BATCH = byte(22)
+	// Answer to get_peer_stats
+	RES_ID_PEER_STATS = byte(23)
+	// Clock synchronization
+	RES_ID_TIME_SYNC   = byte(24)
+	RES_ID_SERVER_TIME = byte(25)
+	// WebRTC signaling
+	RES_ID_SIGNAL = byte(26)
+	// A peer ID changing hands when the host leaves
+	RES_ID_PEER_REMAP = byte(27)
 )
 
 /*
@@ -24,14 +58,60 @@ const (
 	CONF_HOSTED_MATCH = byte(2)
 	CONF_FAILED_HOST  = byte(3)
 	CONF_CONNECTED    = byte(4)
+	// Matchmaking
+	CONF_QUEUED          = byte(5)
+	CONF_FAILED_QUEUE    = byte(6)
+	CONF_QUEUE_CANCELLED = byte(7)
+	CONF_QUEUE_TIMEOUT   = byte(8)
+	CONF_MATCH_FOUND     = byte(9)
+	// Spectating
+	CONF_SPECTATING      = byte(10)
+	CONF_FAILED_SPECTATE = byte(11)
+	CONF_LEFT_MATCH      = byte(12)
+)
+
+/*
+* These are bit flags in the features byte that follows the GUID in the connected confirmation, from protocol version 2
+ */
+const (
+	FEATURE_COMPRESSION = byte(1 << 0)
+	// The features byte is followed by a resume token
+	FEATURE_RESUME = byte(1 << 1)
+	// Followed by a UDP token, after the resume token if there is one
+	FEATURE_UDP = byte(1 << 2)
+	// Ticking matches batch relay packets for the client
+	FEATURE_BATCHING = byte(1 << 3)
+	// Commands and responses are CBOR
+	FEATURE_CBOR = byte(1 << 4)
+	// Large messages are sent to the client in fragments
+	FEATURE_FRAGMENTATION = byte(1 << 5)
 )
 
 /*
 * These are used to identify the prefix bit on a packet to know whether its a server command or relay message
  */
 const (
-	CMD_PREFIX   = byte(0)
-	RELAY_PREFIX = byte(1)
+	CMD_PREFIX      = byte(0)
+	RELAY_PREFIX    = byte(1)
+	FRAGMENT_PREFIX = byte(2)
+	RELIABLE_PREFIX = byte(3)
+	ACK_PREFIX      = byte(4)
+	LATEST_PREFIX   = byte(5)
+)
+
+/*
+* These are used to identify the type of error response sent to a client
+ */
+const (
+	ERR_MESSAGE_TOO_LARGE = byte(0)
+	ERR_BAD_FRAGMENT      = byte(1)
+	ERR_BAD_COMMAND       = byte(2)
+	ERR_AMBIGUOUS_MATCH   = byte(3)
+	ERR_CHAT_REJECTED     = byte(4)
+	ERR_SPECTATING        = byte(5)
+	ERR_BANNED            = byte(6)
+	ERR_STATE_REJECTED    = byte(7)
+	ERR_SIGNAL_REJECTED   = byte(8)
 )
 
 /*
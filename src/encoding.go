@@ -0,0 +1,134 @@
+/** Clients can exchange commands and responses in CBOR (RFC 8949) instead of JSON
+
+A client asks for it with the cbor capability, and FEATURE_CBOR in the connected confirmation says it was granted.
+Commands after CMD_PREFIX are then a CBOR map, and every response or notification that has a JSON body has it in CBOR instead.
+Both encodings share one schema: the same keys, the same values, the same commands.
+
+Each client has the codec it negotiated. The hub decodes commands with it straight into the command structs,
+and notifications are encoded with it for each recipient, see Notification.
+Bodies that aren't JSON, like confirmation and error messages, stay plain text, and relay traffic is never touched.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"reflect"
+)
+
+// Codec encodes the bodies of commands and server messages, CBOR follows the json struct tags so both share one schema
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cborDecoder.Unmarshal(data, v) }
+
+var (
+	JSONCodec Codec = jsonCodec{}
+	CBORCodec Codec = cborCodec{}
+)
+
+var cborDecoder, _ = cbor.DecOptions{
+	// JSON objects only have string keys
+	DefaultMapType:  reflect.TypeOf(map[string]any(nil)),
+	MaxNestedLevels: 32,
+}.DecMode()
+
+// Value is a free-form value in a command, like a state value, kept encoded as it arrived
+// It is only converted when it goes out to a client that uses the other codec
+type Value struct {
+	raw   []byte
+	codec Codec
+}
+
+// JSONValue wraps a JSON encoded value
+func JSONValue(raw []byte) Value {
+	return Value{raw: raw, codec: JSONCodec}
+}
+
+// Len is the size of the value as it arrived, zero if it was missing
+func (v Value) Len() int {
+	return len(v.raw)
+}
+
+// Convertible reports whether the value can be sent to clients of either codec
+func (v Value) Convertible() bool {
+	if v.codec != CBORCodec {
+		return true
+	}
+	_, err := v.MarshalJSON()
+	return err == nil
+}
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	*v = JSONValue(bytes.Clone(data))
+	return nil
+}
+
+func (v *Value) UnmarshalCBOR(data []byte) error {
+	*v = Value{raw: bytes.Clone(data), codec: CBORCodec}
+	return nil
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch v.codec {
+	case nil:
+		return []byte("null"), nil
+	case JSONCodec:
+		return v.raw, nil
+	}
+	var value any
+	if err := cborDecoder.Unmarshal(v.raw, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func (v Value) MarshalCBOR() ([]byte, error) {
+	switch v.codec {
+	case nil:
+		return cbor.Marshal(nil)
+	case CBORCodec:
+		return v.raw, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(v.raw))
+	// Numbers are kept exact so integers stay integers
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(cborNumbers(value))
+}
+
+// cborNumbers replaces the json.Numbers in a decoded JSON value with integers or floats
+func cborNumbers(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]any:
+		for key, element := range value {
+			value[key] = cborNumbers(element)
+		}
+	case []any:
+		for i, element := range value {
+			value[i] = cborNumbers(element)
+		}
+	}
+	return value
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+var codecs = []struct {
+	name  string
+	query string
+	codec Codec
+}{
+	{"json", "version=2", JSONCodec},
+	{"cbor", "version=2&capabilities=cbor", CBORCodec},
+}
+
+// sendCommand sends a command in the codec
+func sendCommand(tb testing.TB, client *testClient, codec Codec, command map[string]any) {
+	tb.Helper()
+	encoded, err := codec.Marshal(command)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	client.Write(append([]byte{CMD_PREFIX}, encoded...))
+}
+
+// decodeBody decodes the body of a server message that starts after its header
+func decodeBody(tb testing.TB, codec Codec, message []byte, header int, v any) {
+	tb.Helper()
+	if err := codec.Unmarshal(message[header:], v); err != nil {
+		tb.Fatalf("could not decode %q: %v", message, err)
+	}
+}
+
+func TestCommandsInEitherCodec(t *testing.T) {
+	tests := []struct {
+		name    string
+		command map[string]any
+		resID   byte
+		// Checks the response, whose body follows its RES_ID and any code
+		check func(t *testing.T, codec Codec, message []byte)
+	}{
+		{"host_match", map[string]any{"action": HOST_MATCH, "name": "arena", "region": "eu", "tags": []string{"ranked"}}, RES_ID_CONFIRMATION, func(t *testing.T, codec Codec, message []byte) {
+			var description MatchDescription
+			decodeBody(t, codec, message, 2, &description)
+			if message[1] != CONF_HOSTED_MATCH || description.Name != "arena" || description.Region != "eu" || len(description.Tags) != 1 || description.MaxPlayers != defaultMaxClients {
+				t.Errorf("hosted %+v", description)
+			}
+		}},
+		{"list_matches", map[string]any{"action": LIST_MATCHES, "limit": 5}, RES_ID_COMMAND_RES, func(t *testing.T, codec Codec, message []byte) {
+			var listing MatchListing
+			decodeBody(t, codec, message, 1, &listing)
+			if listing.Matches == nil {
+				t.Errorf("listed %+v", listing)
+			}
+		}},
+		{"time_sync", map[string]any{"action": TIME_SYNC, "client_time": 1234567890123}, RES_ID_TIME_SYNC, func(t *testing.T, codec Codec, message []byte) {
+			var response struct {
+				ClientTime int64 `json:"client_time"`
+				Receive    int64 `json:"receive"`
+				Transmit   int64 `json:"transmit"`
+			}
+			decodeBody(t, codec, message, 1, &response)
+			if response.ClientTime != 1234567890123 || response.Receive == 0 || response.Transmit < response.Receive {
+				t.Errorf("time sync %+v", response)
+			}
+		}},
+		{"create_party", map[string]any{"action": CREATE_PARTY}, RES_ID_PARTY_UPDATE, func(t *testing.T, codec Codec, message []byte) {
+			var party PartyDescription
+			decodeBody(t, codec, message, 1, &party)
+			if len(party.Members) != 1 {
+				t.Errorf("party %+v", party)
+			}
+		}},
+	}
+	for _, codec := range codecs {
+		for _, test := range tests {
+			t.Run(codec.name+"/"+test.name, func(t *testing.T) {
+				client := connect(t, startHub(), codec.query)
+				sendCommand(t, client, codec.codec, test.command)
+				test.check(t, codec.codec, client.Expect(test.resID))
+			})
+		}
+	}
+}
+
+func TestMalformedCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		command []byte
+	}{
+		{"truncated json", "version=2", []byte(`{"action":`)},
+		{"json array", "version=2", []byte(`["host_match"]`)},
+		{"truncated cbor", "version=2&capabilities=cbor", []byte{0xa1, 0x66}},
+		{"cbor array", "version=2&capabilities=cbor", []byte{0x81, 0x01}},
+		{"json to a cbor client", "version=2&capabilities=cbor", []byte(`{"action":"host_match"}`)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := connect(t, startHub(), test.query)
+			client.Write(append([]byte{CMD_PREFIX}, test.command...))
+			if message := client.Expect(RES_ID_ERROR); message[1] != ERR_BAD_COMMAND {
+				t.Errorf("got %q, want a bad command error", message)
+			}
+		})
+	}
+}
+
+// State values are kept as they were sent and converted for clients of the other codec
+func TestStateValuesAcrossCodecs(t *testing.T) {
+	value := map[string]any{"hp": 10, "name": "knight", "position": []any{1.5, -2}, "big": 12345678901234567}
+	want, err := JSONCodec.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, writer := range codecs {
+		for _, reader := range codecs {
+			t.Run(writer.name+" to "+reader.name, func(t *testing.T) {
+				hub := startHub()
+				host := connect(t, hub, writer.query)
+				peer := connect(t, hub, reader.query)
+
+				sendCommand(t, host, writer.codec, map[string]any{"action": HOST_MATCH})
+				var description MatchDescription
+				decodeBody(t, writer.codec, host.Expect(RES_ID_CONFIRMATION), 2, &description)
+				sendCommand(t, peer, reader.codec, map[string]any{"action": JOIN_MATCH, "uuid": description.Guid})
+				host.Expect(RES_ID_PEER_CONNECTED)
+
+				sendCommand(t, host, writer.codec, map[string]any{"action": SET_STATE, "key": "player", "value": value})
+				var change StateChange
+				decodeBody(t, reader.codec, peer.Expect(RES_ID_STATE_UPDATE), 1, &change)
+				got, err := JSONCodec.Marshal(change.Entry.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("value %s, want %s", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestValueConversion(t *testing.T) {
+	tests := []string{
+		`null`,
+		`true`,
+		`42`,
+		`-7`,
+		`12345678901234567`,
+		`1.5`,
+		`"text"`,
+		`[1,"two",[3]]`,
+		`{"a":{"b":null},"c":[]}`,
+	}
+	for _, test := range tests {
+		t.Run(test, func(t *testing.T) {
+			encoded, err := CBORCodec.Marshal(JSONValue([]byte(test)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var value Value
+			if err := CBORCodec.Unmarshal(encoded, &value); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := JSONCodec.Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != test {
+				t.Errorf("came back as %s", decoded)
+			}
+		})
+	}
+}
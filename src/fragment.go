@@ -0,0 +1,131 @@
+/** Fragments let payloads larger than the per message limits, such as initial world state, cross the relay
+
+Every fragment is prefixed with a little endian header of message ID, fragment index and fragment count, each a uint16.
+Inbound fragments are sent with FRAGMENT_PREFIX and reassemble into a whole message starting with CMD_PREFIX or RELAY_PREFIX.
+Outbound fragments are sent with RES_ID_FRAGMENT and reassemble into a whole message starting with its usual RES_ID prefix.
+Only clients that negotiated the fragmentation capability get outbound fragments, the rest get large messages whole.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	fragmentHeaderSize  = 6
+	maxPendingFragments = 4
+	fragmentTimeout     = 30 * time.Second
+)
+
+type fragmentBuffer struct {
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// Reassembler collects the inbound fragments of a single client, it is only used from the client's read pump
+type Reassembler struct {
+	pending map[uint16]*fragmentBuffer
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		pending: make(map[uint16]*fragmentBuffer),
+	}
+}
+
+// Add stores the fragment and returns the whole message once every fragment has arrived, nil otherwise
+func (r *Reassembler) Add(fragment []byte) ([]byte, error) {
+	if len(fragment) < fragmentHeaderSize {
+		return nil, errors.New("fragment is too short to contain a header")
+	}
+
+	id := binary.LittleEndian.Uint16(fragment[0:2])
+	index := int(binary.LittleEndian.Uint16(fragment[2:4]))
+	count := int(binary.LittleEndian.Uint16(fragment[4:6]))
+	payload := fragment[fragmentHeaderSize:]
+
+	if count == 0 || index >= count {
+		return nil, errors.New("fragment index is out of range")
+	}
+
+	r.expire()
+
+	buffer := r.pending[id]
+	if buffer == nil {
+		if len(r.pending) >= maxPendingFragments {
+			return nil, errors.New("too many messages are being reassembled at once")
+		}
+		buffer = &fragmentBuffer{
+			parts:   make([][]byte, count),
+			started: time.Now(),
+		}
+		r.pending[id] = buffer
+	}
+
+	if len(buffer.parts) != count {
+		delete(r.pending, id)
+		return nil, errors.New("fragment count changed mid message")
+	}
+	if buffer.parts[index] != nil {
+		delete(r.pending, id)
+		return nil, errors.New("duplicate fragment")
+	}
+
+	buffer.size += len(payload)
+	if buffer.size > *maxReassembledSize {
+		delete(r.pending, id)
+		return nil, errors.New("reassembled message is too large")
+	}
+
+	buffer.parts[index] = payload
+	buffer.received++
+	if buffer.received < count {
+		return nil, nil
+	}
+
+	delete(r.pending, id)
+	message := make([]byte, 0, buffer.size)
+	for _, part := range buffer.parts {
+		message = append(message, part...)
+	}
+	if len(message) > 0 && message[0] == FRAGMENT_PREFIX {
+		return nil, errors.New("fragments cannot be nested")
+	}
+	return message, nil
+}
+
+// expire drops partially received messages whose remaining fragments never showed up
+func (r *Reassembler) expire() {
+	for id, buffer := range r.pending {
+		if time.Since(buffer.started) > fragmentTimeout {
+			delete(r.pending, id)
+		}
+	}
+}
+
+// Fragment splits an outbound message into RES_ID_FRAGMENT packets of at most fragmentSize payload bytes
+func Fragment(id uint16, message []byte, size int) [][]byte {
+	count := (len(message) + size - 1) / size
+	if count > math.MaxUint16 {
+		return nil
+	}
+
+	fragments := make([][]byte, 0, count)
+	for index := 0; index < count; index++ {
+		end := min((index+1)*size, len(message))
+
+		fragment := make([]byte, 1+fragmentHeaderSize, 1+fragmentHeaderSize+end-index*size)
+		fragment[0] = RES_ID_FRAGMENT
+		binary.LittleEndian.PutUint16(fragment[1:3], id)
+		binary.LittleEndian.PutUint16(fragment[3:5], uint16(index))
+		binary.LittleEndian.PutUint16(fragment[5:7], uint16(count))
+		fragments = append(fragments, append(fragment, message[index*size:end]...))
+	}
+	return fragments
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+func TestOutboundFragmentationIsNegotiated(t *testing.T) {
+	setFlag(t, fragmentation, true)
+	setFlag(t, fragmentSize, 64)
+	hub := startHub()
+
+	tests := []struct {
+		name      string
+		query     string
+		fragments bool
+	}{
+		{"without the capability", "version=2", false},
+		{"with the capability", "version=2&capabilities=fragmentation", true},
+		{"on version 1", "capabilities=fragmentation", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := connect(t, hub, test.query)
+			client.Command(map[string]any{"action": HOST_MATCH})
+			message := client.Read()
+			if fragmented := message[0] == RES_ID_FRAGMENT; fragmented != test.fragments {
+				t.Errorf("got %q, fragmented %v, want fragmented %v", message, fragmented, test.fragments)
+			}
+		})
+	}
+}
+
+// fragments splits the message into inbound fragments of at most size bytes each
+func fragments(id uint16, message []byte, size int) [][]byte {
+	count := (len(message) + size - 1) / size
+	var parts [][]byte
+	for index := 0; index < count; index++ {
+		part := []byte{FRAGMENT_PREFIX}
+		part = binary.LittleEndian.AppendUint16(part, id)
+		part = binary.LittleEndian.AppendUint16(part, uint16(index))
+		part = binary.LittleEndian.AppendUint16(part, uint16(count))
+		parts = append(parts, append(part, message[index*size:min((index+1)*size, len(message))]...))
+	}
+	return parts
+}
+
+func TestInboundFragmentsReassemble(t *testing.T) {
+	setFlag(t, fragmentation, true)
+	setFlag(t, fragmentSize, 64)
+	setFlag(t, maxRelaySize, 64)
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	peer := connect(t, hub, "username=peer")
+	hostAndJoin(t, host, peer)
+
+	// A relay packet over the relay limit, with its fragments out of order
+	payload := bytes.Repeat([]byte("world state "), 16)
+	relay := append(append([]byte{RELAY_PREFIX}, peer.id...), payload...)
+	parts := fragments(1, relay, *fragmentSize)
+	for _, index := range []int{2, 0, 3, 1} {
+		host.Write(parts[index])
+	}
+	for {
+		message := peer.Expect(RES_ID_RELAY_MSG)
+		if bytes.HasSuffix(message, payload) {
+			if !bytes.Equal(message[1:1+relayPeerIDSize], []byte(host.id)) {
+				t.Errorf("reassembled packet came from %q, want %q", message[1:1+relayPeerIDSize], host.id)
+			}
+			break
+		}
+	}
+
+	// Commands reassemble too
+	command, _ := json.Marshal(map[string]any{"action": LIST_MATCHES})
+	for _, part := range fragments(2, append([]byte{CMD_PREFIX}, command...), 8) {
+		host.Write(part)
+	}
+	host.Expect(RES_ID_COMMAND_RES)
+}
+
+func TestOversizedMessagesAreRejected(t *testing.T) {
+	setFlag(t, fragmentation, true)
+	setFlag(t, fragmentSize, 64)
+	setFlag(t, maxRelaySize, 64)
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	peer := connect(t, hub, "username=peer")
+	hostAndJoin(t, host, peer)
+
+	tests := []struct {
+		name    string
+		message []byte
+	}{
+		{"relay", append(append([]byte{RELAY_PREFIX}, peer.id...), make([]byte, *maxRelaySize)...)},
+		{"fragment", fragments(1, make([]byte, 2**fragmentSize), 2**fragmentSize)[0]},
+		{"command", append([]byte{CMD_PREFIX}, make([]byte, *maxCommandSize+1)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host.Write(test.message)
+			if rejected := host.Expect(RES_ID_ERROR); rejected[1] != ERR_MESSAGE_TOO_LARGE {
+				t.Errorf("got %q, want a message too large error", rejected)
+			}
+			// The connection stays open
+			host.Command(map[string]any{"action": LIST_MATCHES})
+			host.Expect(RES_ID_COMMAND_RES)
+		})
+	}
+}
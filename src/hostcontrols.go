@@ -0,0 +1,221 @@
+/** Host controls give the host of a match authority over who is in it
+
+The host can kick a peer, ban a peer from coming back, mute a peer's relay or chat traffic, and lock the match against new joins.
+Commands name the peer by its connection GUID, but bans are kept by IP so reconnecting doesn't get around them.
+Identities are self-chosen usernames (see Client.Identity), so banning one would be evaded by picking another name and would lock out whoever takes the banned name.
+The identity a ban was placed under is only kept so the host can lift it by name.
+Every action is logged with an AUDIT prefix.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"log"
+)
+
+// KickPeer is used by kick_peer, ban_peer and unban_peer
+type KickPeer struct {
+	UUID string `json:"uuid"`
+	// Unbans can name the identity the ban was placed under instead, for peers that have left the server
+	Identity string `json:"identity"`
+	Reason   string `json:"reason"`
+}
+
+// MutePeer sets both mutes of the peer, so sending false for both unmutes it
+type MutePeer struct {
+	UUID  string `json:"uuid"`
+	Relay bool   `json:"relay"`
+	Chat  bool   `json:"chat"`
+}
+
+type LockMatch struct {
+	Locked bool `json:"locked"`
+}
+
+// Removal tells a kicked or banned peer which match it was removed from and why
+type Removal struct {
+	Match  string `json:"match"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// PeerMute is what the host has muted of a peer
+type PeerMute struct {
+	Relay bool
+	Chat  bool
+}
+
+// Mute returns what the host has muted of the client
+func (m *Match) Mute(client *Client) PeerMute {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.mutes[client.guid.String()]
+}
+
+func (m *Match) SetMute(guid string, mute PeerMute) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if mute == (PeerMute{}) {
+		delete(m.mutes, guid)
+	} else {
+		m.mutes[guid] = mute
+	}
+}
+
+// Refuses returns why the clients can't come into the match, empty if they can
+func (m *Match) Refuses(clients []*Client) string {
+	if m.locked {
+		return "Match is locked"
+	}
+	for _, client := range clients {
+		if m.Bans(client) {
+			return "Banned from match"
+		}
+	}
+	return ""
+}
+
+// Bans returns whether the client's IP is banned from the match
+func (m *Match) Bans(client *Client) bool {
+	_, banned := m.banned[client.ip]
+	return banned
+}
+
+// hostedMatch returns the match the client hosts, sending the client an error if it hosts none
+func (h *Hub) hostedMatch(client *Client) *Match {
+	match := h.matchByClient[client]
+	// Replays have no host, so nobody passes for them
+	if match == nil || match.host != client {
+		msg := "Only the host can do that"
+		log.Println(msg)
+		client.SendError(ERR_BAD_COMMAND, msg)
+		return nil
+	}
+	return match
+}
+
+func (h *Hub) HandleKickPeer(client *Client, action string, message KickPeer) error {
+	log.Printf("%v requested...", action)
+
+	match := h.hostedMatch(client)
+	if match == nil {
+		return nil
+	}
+
+	var peer *Client
+	identity, ip := message.Identity, ""
+	if action == UNBAN_PEER && message.UUID == "" {
+		for banned, name := range match.banned {
+			if name == identity {
+				ip = banned
+			}
+		}
+	} else {
+		uid, err := DecodeUUID(message.UUID)
+		if err != nil {
+			return err
+		}
+		peer = match.Client(uid.String())
+		if peer == nil {
+			peer = match.Spectator(uid.String())
+		}
+		// Peers can be banned before they ever join, as long as they are connected
+		target := peer
+		if target == nil {
+			target = h.clients[uid.String()]
+		}
+		if target != nil {
+			identity, ip = target.Identity(), target.ip
+		}
+	}
+	if peer == client {
+		client.SendError(ERR_BAD_COMMAND, "The host can't do that to itself")
+		return nil
+	}
+	if action == BAN_PEER && ip == client.ip {
+		client.SendError(ERR_BAD_COMMAND, "Peer shares the host's IP")
+		return nil
+	}
+
+	switch action {
+	case UNBAN_PEER:
+		if _, banned := match.banned[ip]; !banned {
+			client.SendError(ERR_BAD_COMMAND, "Peer is not banned from the match")
+			return nil
+		}
+		log.Printf("AUDIT %v unbanned %q, IP %q, from match %v", client.username, match.banned[ip], ip, match.meta.Name)
+		delete(match.banned, ip)
+		return nil
+	case BAN_PEER:
+		if ip == "" {
+			client.SendError(ERR_BAD_COMMAND, "Peer is not connected")
+			return nil
+		}
+		match.banned[ip] = identity
+		log.Printf("AUDIT %v banned %q, IP %q, from match %v: %q", client.username, identity, ip, match.meta.Name, message.Reason)
+		// Every connection from the IP goes, not just the one named
+		for _, member := range append(match.Clients(), match.Spectators()...) {
+			if member != client && match.Bans(member) {
+				if err := h.RemovePeer(match, member, RES_ID_BANNED, message.Reason); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		if peer == nil {
+			client.SendError(ERR_BAD_COMMAND, "Peer is not in the match")
+			return nil
+		}
+		log.Printf("AUDIT %v kicked %v (%v) from match %v: %q", client.username, peer.username, peer.guid, match.meta.Name, message.Reason)
+		return h.RemovePeer(match, peer, RES_ID_KICKED, message.Reason)
+	}
+}
+
+// RemovePeer takes the peer out of the match and tells it why with a kicked or banned notification
+func (h *Hub) RemovePeer(match *Match, peer *Client, resID byte, reason string) error {
+	h.RemoveFromMatch(peer)
+
+	peer.Notify(NewNotification(Removal{
+		Match:  base64.StdEncoding.EncodeToString(match.meta.Guid[:]),
+		Reason: reason,
+	}, resID))
+	return nil
+}
+
+func (h *Hub) HandleMutePeer(client *Client, message MutePeer) error {
+	log.Println("Mute peer requested...")
+
+	match := h.hostedMatch(client)
+	if match == nil {
+		return nil
+	}
+	uid, err := DecodeUUID(message.UUID)
+	if err != nil {
+		return err
+	}
+	if match.Client(uid.String()) == nil && match.Spectator(uid.String()) == nil {
+		client.SendError(ERR_BAD_COMMAND, "Peer is not in the match")
+		return nil
+	}
+
+	match.SetMute(uid.String(), PeerMute{Relay: message.Relay, Chat: message.Chat})
+	log.Printf("AUDIT %v set mute of %v in match %v to relay %v, chat %v", client.username, uid, match.meta.Name, message.Relay, message.Chat)
+	return nil
+}
+
+func (h *Hub) HandleLockMatch(client *Client, message LockMatch) error {
+	log.Println("Lock match requested...")
+
+	match := h.hostedMatch(client)
+	if match == nil {
+		return nil
+	}
+
+	match.locked = message.Locked
+	h.LobbyChanged(match)
+	log.Printf("AUDIT %v set lock of match %v to %v", client.username, match.meta.Name, message.Locked)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBanOutlastsReconnecting(t *testing.T) {
+	hub := startHub()
+	host := connectFrom(t, hub, "username=host", "10.0.0.1")
+	peer := connectFrom(t, hub, "username=griefer", "10.0.0.2")
+	match := hostAndJoin(t, host, peer)
+
+	host.Command(map[string]any{"action": BAN_PEER, "uuid": peer.id, "reason": "griefing"})
+	peer.Expect(RES_ID_BANNED)
+	peer.transport.Close()
+	host.Expect(RES_ID_PEER_DISCONNECTED)
+
+	// A new connection gets a new GUID, and picking another name doesn't help
+	tests := []struct {
+		name   string
+		query  string
+		ip     string
+		banned bool
+	}{
+		{"same IP", "username=griefer", "10.0.0.2", true},
+		{"same IP, other name", "username=bystander", "10.0.0.2", true},
+		{"other IP, banned name", "username=griefer", "10.0.0.3", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := connectFrom(t, hub, test.query, test.ip)
+			client.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+			if test.banned {
+				if refused := client.Expect(CONF_FAILED_JOIN); string(refused[1:]) != "Banned from match" {
+					t.Errorf("got %q joining", refused)
+				}
+			} else {
+				host.Expect(RES_ID_PEER_CONNECTED)
+			}
+		})
+	}
+
+	host.Command(map[string]any{"action": UNBAN_PEER, "identity": "griefer"})
+	// Unbanning has no response, a listing after it shows the hub got to it
+	host.Command(map[string]any{"action": LIST_MATCHES})
+	host.Expect(RES_ID_COMMAND_RES)
+	returning := connectFrom(t, hub, "username=griefer", "10.0.0.2")
+	returning.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	host.Expect(RES_ID_PEER_CONNECTED)
+}
+
+func TestHostCantBanItsOwnIP(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	peer := connect(t, hub, "username=roommate")
+	hostAndJoin(t, host, peer)
+
+	host.Command(map[string]any{"action": BAN_PEER, "uuid": peer.id})
+	if message := host.Expect(RES_ID_ERROR); string(message[2:]) != "Peer shares the host's IP" {
+		t.Errorf("got %q", message)
+	}
+}
@@ -3,7 +3,20 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
 	"log"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Invite codes leave out characters that are easily confused when read aloud or typed, like O and 0
+const (
+	inviteCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	inviteCodeLength   = 6
 )
 
 type RawMessage []byte
@@ -14,14 +27,44 @@ type Hub struct {
 	matches map[string]*Match
 	// A mapping of matches by client
 	matchByClient map[*Client]*Match
+	// Indexes for joining by name or invite code: normalized name -> matches oldest first, invite code -> match
+	matchesByName map[string][]*Match
+	matchesByCode map[string]*Match
+	// Parties by GUID and by member
+	parties       map[string]*Party
+	partyByClient map[*Client]*Party
+	// Clients browsing the lobby and the matches that changed since they were last told
+	subscriptions map[*Client]*LobbySubscription
+	lobbyChanges  map[string]*Match
 
 	// channels
 	broadcast chan struct {
 		RawMessage
 		*Client
+		// When the client's read pump read the message
+		Received time.Time
 	}
 	register   chan *Client
 	unregister chan *Client
+	// groups of queued clients ready to be placed in a match
+	matchmade chan []*Ticket
+
+	matchmaker *Matchmaker
+	// Every chat message passes this before delivery, replace it to change how chat is moderated
+	chatFilter ChatFilter
+	// Server wide bans and reports, and bans placed through the admin API waiting to be enforced
+	moderation ModerationStore
+	bans       chan Ban
+	// Bearer token for the admin API, empty when it is disabled
+	adminToken string
+	// Clients by resume token, and the ones waiting to be resumed with when their window runs out
+	sessions map[string]*Client
+	detached map[*Client]time.Time
+	claims   chan sessionClaim
+	// Admin requests for the connected clients
+	clientStats chan chan []ClientStats
+	// Nil unless unreliable relay traffic is accepted over UDP
+	udp *UDPServer
 }
 
 type Message struct {
@@ -35,49 +78,210 @@ const (
 )
 
 func NewHub() *Hub {
-	return &Hub{
+	h := &Hub{
 		clients:       make(map[string]*Client),
 		matches:       make(map[string]*Match),
 		matchByClient: make(map[*Client]*Match),
+		matchesByName: make(map[string][]*Match),
+		matchesByCode: make(map[string]*Match),
+		parties:       make(map[string]*Party),
+		partyByClient: make(map[*Client]*Party),
+		subscriptions: make(map[*Client]*LobbySubscription),
+		lobbyChanges:  make(map[string]*Match),
+		sessions:      make(map[string]*Client),
+		detached:      make(map[*Client]time.Time),
 
 		broadcast: make(chan struct {
 			RawMessage
 			*Client
+			Received time.Time
 		}),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		matchmade:  make(chan []*Ticket),
+		bans:       make(chan Ban),
+		claims:     make(chan sessionClaim),
+
+		clientStats: make(chan chan []ClientStats),
 	}
+	h.matchmaker = NewMatchmaker(h)
+	h.chatFilter = NewWordListFilter(nil)
+	h.moderation = NewMemoryStore()
+	return h
+}
+
+// FindMatchByName returns the matches whose name matches the query name oldest first, returns nil if nothing found
+func (h *Hub) FindMatchByName(name string) []*Match {
+	return h.matchesByName[NormalizeMatchName(name)]
+}
+
+// FindMatchByCode returns the match with the invite code, returns nil if nothing found
+func (h *Hub) FindMatchByCode(code string) *Match {
+	return h.matchesByCode[strings.ToUpper(strings.TrimSpace(code))]
 }
 
-// FindMatchByName returns a match whose name matches the query name, returns nil if nothing found
-func (h *Hub) FindMatchByName(name string) *Match {
-	for guid := range h.matches {
-		if h.matches[guid].meta.Name == name {
-			return h.matches[guid]
+// NormalizeMatchName lets players type a match name the way they heard it, ignoring case and separators
+func NormalizeMatchName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '_' {
+			return -1
 		}
+		return unicode.ToLower(r)
+	}, name)
+}
+
+// IndexMatch makes the match findable by its name and invite code
+func (h *Hub) IndexMatch(match *Match) {
+	name := NormalizeMatchName(match.meta.Name)
+	h.matchesByName[name] = append(h.matchesByName[name], match)
+	h.matchesByCode[match.meta.Code] = match
+}
+
+// UnindexMatch is called when a match ends or before it is renamed
+func (h *Hub) UnindexMatch(match *Match) {
+	name := NormalizeMatchName(match.meta.Name)
+	h.matchesByName[name] = slices.DeleteFunc(h.matchesByName[name], func(m *Match) bool { return m == match })
+	if len(h.matchesByName[name]) == 0 {
+		delete(h.matchesByName, name)
 	}
+	delete(h.matchesByCode, match.meta.Code)
+}
 
-	return nil
+// NewInviteCode returns a short code that isn't used by any current match
+func (h *Hub) NewInviteCode() string {
+	for {
+		code := make([]byte, inviteCodeLength)
+		for i := range code {
+			code[i] = inviteCodeAlphabet[rand.Intn(len(inviteCodeAlphabet))]
+		}
+		if h.matchesByCode[string(code)] == nil {
+			return string(code)
+		}
+	}
 }
 
 func (h *Hub) HandleRegistration(client *Client) {
-	h.clients[client.guid.String()] = client
-	log.Printf("Registering user with GUID %v, username %v", client.guid, client.username)
+	if client.resumes != nil {
+		h.Resume(client.resumes, client)
+		client.resumes = nil
+	} else {
+		h.clients[client.guid.String()] = client
+		if client.resumeToken != "" {
+			h.sessions[client.resumeToken] = client
+		}
+		log.Printf("Registering user with GUID %v, username %v", client.guid, client.username)
+	}
 
 	notify := []byte{RES_ID_CONFIRMATION}
 	notify = append(notify, CONF_CONNECTED)
 	notify = append(notify, []byte(base64.StdEncoding.EncodeToString(client.guid[:]))...)
-	client.send <- notify
+	// Version 1 confirmations end at the GUID, as they always did
+	if client.protocol >= 2 {
+		notify = append(notify, client.Features(), byte(client.protocol))
+		notify = append(notify, client.resumeToken...)
+		notify = append(notify, client.udpToken...)
+	}
+	client.Send(notify)
+	h.udp.Add(client)
+	// Reliable packets that went unacked on the old connection follow the confirmation
+	client.reliable.Attach(client)
 }
 
+// HandleUnregistration is called when the client's connection drops, the client is detached instead if it can resume
 func (h *Hub) HandleUnregistration(client *Client) {
-	if _, c := h.clients[client.guid.String()]; c {
+	// A client replaced by a resumed connection, or already disconnected, is gone already
+	if h.clients[client.guid.String()] != client {
+		log.Printf("Unregistering user with GUID %v, username %v", client.guid, client.username)
+		return
+	}
+	if client.resumeToken != "" {
+		h.Detach(client)
+		return
+	}
+	h.Disconnect(client)
+}
+
+// Disconnect removes the client from the server for good
+func (h *Hub) Disconnect(client *Client) {
+	if h.clients[client.guid.String()] == client {
+		// Closed first so the match goroutine can't block sending to the client while the hub waits on it
+		client.Close()
 		delete(h.clients, client.guid.String())
-		close(client.send)
+		delete(h.sessions, client.resumeToken)
+		delete(h.detached, client)
+		h.udp.Remove(client)
+		h.matchmaker.Cancel(client)
+		delete(h.subscriptions, client)
+		h.LeaveParty(client)
+		for _, party := range h.parties {
+			delete(party.invited, client)
+		}
+		h.RemoveFromMatch(client)
+		client.reliable.FailAll()
 	}
 	log.Printf("Unregistering user with GUID %v, username %v", client.guid, client.username)
 }
 
+// RemoveFromMatch takes the client out of whatever match it is in, ending the match once it is empty
+func (h *Hub) RemoveFromMatch(client *Client) {
+	match := h.matchByClient[client]
+	if match == nil {
+		return
+	}
+
+	delete(h.matchByClient, client)
+	client.match.Store(nil)
+	h.LobbyChanged(match)
+
+	if match.RemoveSpectator(client) {
+		if match.replay && len(match.Spectators()) == 0 {
+			log.Printf("Replay %v has no spectators left, ending it", match.meta.Name)
+			h.EndMatch(match)
+			return
+		}
+		match.Broadcast(NewNotification(client.Description(), RES_ID_SPECTATOR_DISCONNECTED))
+		return
+	}
+
+	RecordPeer(match, RECORD_LEAVE, client)
+	if match.RemoveClient(client) == 0 {
+		log.Printf("Match %v is empty, ending it", match.meta.Name)
+		h.EndMatch(match)
+
+		// Spectators see the last player leave and are left outside of any match
+		notify := NewNotification(client.Description(), RES_ID_PEER_DISCONNECTED)
+		for _, spectator := range match.Spectators() {
+			spectator.Notify(notify)
+		}
+		for _, spectator := range match.Spectators() {
+			match.RemoveSpectator(spectator)
+			delete(h.matchByClient, spectator)
+			spectator.match.Store(nil)
+		}
+		return
+	}
+
+	match.Broadcast(NewNotification(client.Description(), RES_ID_PEER_DISCONNECTED))
+
+	if match.host == client {
+		match.host = LowestLatency(match.Clients())
+		log.Printf("Host left match %v, %v is the new host", match.meta.Name, match.host.username)
+		match.Broadcast(NewNotification(PeerRemap{
+			UUID:   base64.StdEncoding.EncodeToString(match.host.guid[:]),
+			From:   match.PromoteHost(match.host),
+			PeerID: TARGET_PEER_HOST,
+		}, RES_ID_PEER_REMAP))
+	}
+}
+
+// EndMatch stops the match and forgets it, whoever is still in it is left to the caller
+func (h *Hub) EndMatch(match *Match) {
+	delete(h.matches, match.meta.Guid.String())
+	h.UnindexMatch(match)
+	match.Stop()
+	match.recorder.Close()
+}
+
 func ExtractAction(message []byte) (string, error) {
 	var data map[string]json.RawMessage
 	if err := json.Unmarshal(message, &data); err != nil {
@@ -155,20 +359,26 @@ const (
 //	return nil
 //}
 
-func (h *Hub) HandleMessage(message []byte, client *Client) error {
+func (h *Hub) HandleMessage(message []byte, client *Client, received time.Time) error {
 	log.Println("Handling message...")
+	if len(message) == 0 {
+		return errors.New("received an empty message")
+	}
 	var classifyingPrefix = message[0]
 	log.Println("Analyzing prefix...")
 	switch classifyingPrefix {
 	case SERVER_COMMAND:
 		log.Println("Handling server message")
 		// Interpret the remainder of the packet as JSON
-		return h.HandleServerCommand(client, message[1:])
-	case RELAY_MESSAGE:
-		log.Println("Handling relay message")
-		// Structure the relay message struct
-		relayMessage := h.SplitRelayMessage(message[1:], client)
-		return h.HandleRelayMessage(relayMessage)
+		return h.HandleServerCommand(client, message[1:], received)
+	case RELAY_MESSAGE, LATEST_PREFIX:
+		// Relay messages for clients in a match never reach the hub, see Client.readPump
+		log.Println("Dropping relay message from client outside of a match")
+	case RELIABLE_PREFIX:
+		log.Println("Failing reliable message from client outside of a match")
+		if _, senderSeq, err := SplitReliableMessage(message[1:]); err == nil {
+			client.reliable.Send(receipt(RECEIPT_FAILED, senderSeq, uuid.Nil))
+		}
 	default:
 		log.Println("Classifying byte not recognized")
 	}
@@ -177,19 +387,41 @@ func (h *Hub) HandleMessage(message []byte, client *Client) error {
 }
 
 func (h *Hub) run() {
+	lobbyTicker := time.NewTicker(*lobbyUpdateInterval)
+	defer lobbyTicker.Stop()
+	// Left nil, and never ready, when resuming is disabled
+	var resumeTicks <-chan time.Time
+	if *resumeWindow > 0 {
+		resumeTicker := time.NewTicker(time.Second)
+		defer resumeTicker.Stop()
+		resumeTicks = resumeTicker.C
+	}
+
 	for {
 		select {
+		case <-lobbyTicker.C:
+			h.FlushLobbyChanges()
+		case now := <-resumeTicks:
+			h.ExpireSessions(now)
+		case claim := <-h.claims:
+			h.HandleClaim(claim)
+		case reply := <-h.clientStats:
+			h.HandleClientStats(reply)
 		case client := <-h.register:
 			h.HandleRegistration(client)
 		case client := <-h.unregister:
 			h.HandleUnregistration(client)
+		case group := <-h.matchmade:
+			h.HandleMatchmade(group)
+		case ban := <-h.bans:
+			h.EnforceBan(ban)
 		case packet := <-h.broadcast:
 			message := packet.RawMessage
 			client := packet.Client
 
 			log.Println(message)
 
-			if err := h.HandleMessage(message, client); err != nil {
+			if err := h.HandleMessage(message, client, packet.Received); err != nil {
 				log.Println(err)
 			}
 		}
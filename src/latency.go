@@ -0,0 +1,167 @@
+/** Latency is measured from the websocket pings the write pump already sends to keep connections alive
+
+Each ping carries the time it was sent, as nanoseconds since the client connected (int64 LE), which websocket clients must echo back in the pong.
+The round trip time is smoothed the way TCP does it (RFC 6298), with the jitter being the smoothed deviation from it.
+
+Players see each other's latency in peer notifications and get_peer_stats, admins see every client's at /admin/clients.
+When a host leaves, the player with the lowest latency takes over.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+)
+
+// Latency is what's been measured of a client's connection, in milliseconds
+type Latency struct {
+	RTT     float64 `json:"rtt_ms"`
+	Jitter  float64 `json:"jitter_ms"`
+	Samples int     `json:"samples"`
+}
+
+// RTTEstimator is fed by the read pump and read from anywhere, so it is guarded by mu
+type RTTEstimator struct {
+	mu      sync.Mutex
+	start   time.Time
+	srtt    time.Duration
+	rttvar  time.Duration
+	samples int
+}
+
+func NewRTTEstimator() *RTTEstimator {
+	return &RTTEstimator{start: time.Now()}
+}
+
+// PingPayload stamps a ping with the time it was sent
+func (e *RTTEstimator) PingPayload() []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(time.Since(e.start)))
+}
+
+// Pong takes a sample from the payload of a pong, ignoring payloads the server didn't send
+func (e *RTTEstimator) Pong(payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	rtt := time.Since(e.start) - time.Duration(binary.LittleEndian.Uint64(payload))
+	if rtt < 0 || rtt > pongWait {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		e.rttvar = (3*e.rttvar + (e.srtt - rtt).Abs()) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.samples++
+}
+
+// Latency returns nil until the first pong comes back
+func (e *RTTEstimator) Latency() *Latency {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.samples == 0 {
+		return nil
+	}
+	return &Latency{
+		RTT:     float64(e.srtt) / float64(time.Millisecond),
+		Jitter:  float64(e.rttvar) / float64(time.Millisecond),
+		Samples: e.samples,
+	}
+}
+
+// PeerDescription describes the client along with its latency, for the other members of its match
+func (c *Client) PeerDescription() ClientDescription {
+	description := c.Description()
+	description.Latency = c.rtt.Latency()
+	description.PeerID = c.match.Load().PeerID(c)
+	return description
+}
+
+// LowestLatency returns the client with the lowest round trip time, clients not yet measured come last
+func LowestLatency(clients []*Client) *Client {
+	best := clients[0]
+	bestLatency := best.rtt.Latency()
+	for _, client := range clients[1:] {
+		latency := client.rtt.Latency()
+		if latency != nil && (bestLatency == nil || latency.RTT < bestLatency.RTT) {
+			best, bestLatency = client, latency
+		}
+	}
+	return best
+}
+
+// GetPeerStats asks for the latency of one player in the match, or every player when UUID is empty
+type GetPeerStats struct {
+	UUID string `json:"uuid"`
+}
+
+func (h *Hub) HandleGetPeerStats(client *Client, message GetPeerStats) error {
+	log.Println("Get peer stats requested...")
+
+	match := h.matchByClient[client]
+	if match == nil {
+		client.SendError(ERR_BAD_COMMAND, "Not in a match")
+		return nil
+	}
+	peers := match.Clients()
+	if message.UUID != "" {
+		uid, err := DecodeUUID(message.UUID)
+		if err != nil {
+			client.SendError(ERR_BAD_COMMAND, "Invalid peer UUID")
+			return nil
+		}
+		peer := match.Client(uid.String())
+		if peer == nil {
+			client.SendError(ERR_BAD_COMMAND, "Peer is not a player in this match")
+			return nil
+		}
+		peers = []*Client{peer}
+	}
+
+	stats := make([]ClientDescription, 0, len(peers))
+	for _, peer := range peers {
+		stats = append(stats, peer.PeerDescription())
+	}
+	client.Notify(NewNotification(stats, RES_ID_PEER_STATS))
+	return nil
+}
+
+// ClientStats is what the admin API shows of a connected client
+type ClientStats struct {
+	ClientDescription
+	IP string `json:"ip"`
+	// GUID of the match the client plays or spectates in, empty if it isn't in one
+	Match    string `json:"match,omitempty"`
+	Detached bool   `json:"detached,omitempty"`
+}
+
+// HandleClientStats answers an admin request for every connected client
+func (h *Hub) HandleClientStats(reply chan []ClientStats) {
+	stats := make([]ClientStats, 0, len(h.clients))
+	for _, client := range h.clients {
+		entry := ClientStats{ClientDescription: client.PeerDescription(), IP: client.ip}
+		if match := h.matchByClient[client]; match != nil {
+			entry.Match = base64.StdEncoding.EncodeToString(match.meta.Guid[:])
+		}
+		_, entry.Detached = h.detached[client]
+		stats = append(stats, entry)
+	}
+	reply <- stats
+}
+
+// ClientStats collects every connected client from the hub goroutine for the admin API
+func (h *Hub) ClientStats() []ClientStats {
+	reply := make(chan []ClientStats, 1)
+	h.clientStats <- reply
+	return <-reply
+}
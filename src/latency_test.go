@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// pong feeds the estimator a pong for a ping sent rtt ago
+func pong(estimator *RTTEstimator, rtt time.Duration) {
+	estimator.Pong(binary.LittleEndian.AppendUint64(nil, uint64(time.Since(estimator.start)-rtt)))
+}
+
+func TestRTTSmoothing(t *testing.T) {
+	estimator := NewRTTEstimator()
+	// Pings stamped before the estimator started would have negative times
+	estimator.start = estimator.start.Add(-2 * pongWait)
+	if estimator.Latency() != nil {
+		t.Fatal("latency before the first pong should be nil")
+	}
+
+	// The first sample sets the RTT and half of it as the jitter, later ones move them by 1/8 and 1/4
+	tests := []struct {
+		sample time.Duration
+		rtt    float64
+		jitter float64
+	}{
+		{100 * time.Millisecond, 100, 50},
+		{200 * time.Millisecond, 112.5, 62.5},
+		{100 * time.Millisecond, 110.9375, 50},
+	}
+	for i, test := range tests {
+		pong(estimator, test.sample)
+		latency := estimator.Latency()
+		// Some time passes between stamping the pong and taking it
+		if math.Abs(latency.RTT-test.rtt) > 1 || math.Abs(latency.Jitter-test.jitter) > 1 || latency.Samples != i+1 {
+			t.Errorf("after a %v sample got %+v, want RTT %v and jitter %v", test.sample, latency, test.rtt, test.jitter)
+		}
+	}
+
+	// Pongs the server couldn't have sent are not samples
+	estimator.Pong([]byte("hello"))
+	pong(estimator, -time.Second)
+	pong(estimator, pongWait+time.Second)
+	if latency := estimator.Latency(); latency.Samples != len(tests) {
+		t.Errorf("bad pongs were taken as samples: %+v", latency)
+	}
+}
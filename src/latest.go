@@ -0,0 +1,97 @@
+/** Latest-only relay packets are for state where only the newest value matters, like positions
+
+Sender:  LATEST_PREFIX | target peer ID (24) | channel | payload
+Target:  RES_ID_LATEST_MSG | channel | sender peer ID (24) | payload
+
+If a target's connection falls behind and still holds an unsent packet from the same sender on the same channel, a new packet replaces it rather than queueing behind it.
+Coalesced packets skip the send queue, so they can arrive before plain relay packets sent earlier.
+Packets over the fragment size are sent as plain queued messages, without coalescing, to clients that take fragments.
+A nil target peer ID sends the packet to every other player and to the spectators, who get every packet.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+)
+
+const latestChannelSize = 1
+
+type latestKey struct {
+	sender  uuid.UUID
+	channel byte
+}
+
+// SplitLatestMessage takes the channel out of a latest-only relay message, leaving a plain relay message
+func SplitLatestMessage(message []byte) ([]byte, byte, error) {
+	if len(message) < relayPeerIDSize+latestChannelSize {
+		return nil, 0, errors.New("latest-only message is too short to contain a peer ID and channel")
+	}
+	channel := message[relayPeerIDSize]
+	relay := append(message[:relayPeerIDSize:relayPeerIDSize], message[relayPeerIDSize+latestChannelSize:]...)
+	return relay, channel, nil
+}
+
+// HandleLatestMessage delivers the packet to its target, or every other player for a broadcast, replacing any older one still waiting
+func (m *Match) HandleLatestMessage(message RelayMessage, sender *Client, channel byte) error {
+	packet := append([]byte{RES_ID_LATEST_MSG, channel}, message.Packet...)
+	key := latestKey{sender: sender.guid, channel: channel}
+
+	if message.PeerID == uuid.Nil {
+		for _, client := range m.Clients() {
+			if client != sender {
+				client.SendLatest(key, packet)
+			}
+		}
+		m.SendToSpectators(packet)
+		return nil
+	}
+
+	client := m.Client(message.PeerID.String())
+	if client == nil {
+		return fmt.Errorf("latest-only target %v is not in match %v", message.PeerID, m.Name())
+	}
+	client.SendLatest(key, packet)
+	return nil
+}
+
+// SendLatest hands the message to the write pump, replacing the message with the same key if it hasn't been written yet
+func (c *Client) SendLatest(key latestKey, message []byte) {
+	// Datagrams don't queue, so there is nothing to coalesce
+	if c.SendUnreliable(message) {
+		return
+	}
+	if c.fragmentation && len(message) > *fragmentSize {
+		c.Send(message)
+		return
+	}
+
+	c.latestMu.Lock()
+	if _, waiting := c.latest[key]; !waiting {
+		c.latestOrder = append(c.latestOrder, key)
+	}
+	c.latest[key] = message
+	c.latestMu.Unlock()
+
+	// The write pump takes every waiting message at once, so one wake up is enough
+	select {
+	case c.latestReady <- struct{}{}:
+	default:
+	}
+}
+
+// takeLatest empties the waiting latest-only messages, oldest key first
+func (c *Client) takeLatest() [][]byte {
+	c.latestMu.Lock()
+	defer c.latestMu.Unlock()
+
+	messages := make([][]byte, 0, len(c.latestOrder))
+	for _, key := range c.latestOrder {
+		messages = append(messages, c.latest[key])
+		delete(c.latest, key)
+	}
+	c.latestOrder = c.latestOrder[:0]
+	return messages
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLatestOnlyReplacesWaitingPackets(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	slow := connect(t, hub, "username=slow")
+	witness := connect(t, hub, "username=witness")
+	hostAndJoin(t, host, slow, witness)
+
+	latest := func(channel byte, payload string) {
+		packet := append([]byte{LATEST_PREFIX}, slow.id...)
+		host.Write(append(append(packet, channel), payload...))
+	}
+	resume := slow.transport.Pause()
+	for i := 1; i <= 5; i++ {
+		latest(0, fmt.Sprint(i))
+	}
+	latest(1, "other channel")
+	// The match goroutine handles the host's packets in order, so once the witness has this one the latest-only ones are all waiting
+	host.Write(append(append([]byte{RELAY_PREFIX}, witness.id...), "sync"...))
+	// The witness's join confirmation also starts with 0, so the payload tells them apart
+	for !strings.HasSuffix(string(witness.Expect(RES_ID_RELAY_MSG)), host.id+"sync") {
+	}
+	resume()
+
+	// The write pump may already have taken one packet before the rest came, every other one is replaced by the newest
+	var channel0 []string
+	var channel1 int
+	for len(channel0) == 0 || channel0[len(channel0)-1] != "5" || channel1 == 0 {
+		message := slow.Expect(RES_ID_LATEST_MSG)
+		if sender := string(message[2 : 2+relayPeerIDSize]); sender != host.id {
+			t.Fatalf("packet is from %q, want the host %q", sender, host.id)
+		}
+		payload := string(message[2+relayPeerIDSize:])
+		switch message[1] {
+		case 0:
+			channel0 = append(channel0, payload)
+		case 1:
+			channel1++
+		}
+	}
+	if len(channel0) > 2 {
+		t.Errorf("got %q on channel 0, older packets should have been replaced", channel0)
+	}
+	if channel1 != 1 {
+		t.Errorf("got %v packets on channel 1, want 1", channel1)
+	}
+}
@@ -0,0 +1,259 @@
+/** The lobby is the listing of hosted matches that clients browse to find one to join
+
+Listings are filtered and sorted on the server and paged with an opaque cursor.
+The cursor holds the sort key of the last match on the page, so a page picks up where the last one ended even as matches come and go.
+
+Clients can instead subscribe with the same filters and have changes pushed to them.
+A subscription starts with every match passing the filters, after which changes are coalesced and sent every lobby update interval.
+Subscriptions ignore sorting and paging, and end when the client hosts or joins a match.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	SORT_BY_PLAYERS = "players"
+	SORT_BY_CREATED = "created"
+	SORT_BY_NAME    = "name"
+)
+
+const (
+	defaultListingLimit = 50
+	maxListingLimit     = 100
+)
+
+// listingCursor is the position of the last match on a page, along with the ordering it was taken in
+type listingCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d"`
+	Players    int    `json:"p"`
+	Created    int64  `json:"c"`
+	Name       string `json:"n"`
+	Guid       string `json:"g"`
+}
+
+func newListingCursor(query ListMatches, match MatchDescription) listingCursor {
+	return listingCursor{
+		SortBy:     query.SortBy,
+		Descending: query.Descending,
+		Players:    match.Players,
+		Created:    match.Created,
+		Name:       match.Name,
+		Guid:       match.Guid,
+	}
+}
+
+func (c listingCursor) Encode() string {
+	packet, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(packet)
+}
+
+func decodeListingCursor(encoded string) (listingCursor, error) {
+	var cursor listingCursor
+	packet, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, errors.New("malformed cursor")
+	}
+	if err := json.Unmarshal(packet, &cursor); err != nil {
+		return cursor, errors.New("malformed cursor")
+	}
+	return cursor, nil
+}
+
+// before reports whether c sorts ahead of other, the GUID breaks ties so every match has a distinct position
+func (c listingCursor) before(other listingCursor) bool {
+	var compared int
+	switch c.SortBy {
+	case SORT_BY_PLAYERS:
+		compared = c.Players - other.Players
+	case SORT_BY_NAME:
+		compared = strings.Compare(c.Name, other.Name)
+	default:
+		compared = int(c.Created - other.Created)
+	}
+	if compared == 0 {
+		compared = strings.Compare(c.Guid, other.Guid)
+	}
+	if c.Descending {
+		return compared > 0
+	}
+	return compared < 0
+}
+
+// Matches reports whether the match passes every filter of the query, replays never do
+func (query ListMatches) Matches(match MatchDescription) bool {
+	if match.Replay {
+		return false
+	}
+	if query.Name != "" && !strings.Contains(strings.ToLower(match.Name), strings.ToLower(query.Name)) {
+		return false
+	}
+	if query.State != "" && match.State != query.State {
+		return false
+	}
+	if query.Region != "" && match.Region != query.Region {
+		return false
+	}
+	if query.HasSlots && (match.Players >= match.MaxPlayers || match.Locked || match.Replay) {
+		return false
+	}
+	for _, tag := range query.Tags {
+		if !slices.Contains(match.Tags, tag) {
+			return false
+		}
+	}
+	for key, value := range query.Properties {
+		if match.Properties[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ListMatches returns a page of the matches passing the query's filters in the query's order
+func (h *Hub) ListMatches(query ListMatches) (MatchListing, error) {
+	if query.SortBy == "" {
+		query.SortBy = SORT_BY_CREATED
+	}
+	if query.SortBy != SORT_BY_PLAYERS && query.SortBy != SORT_BY_CREATED && query.SortBy != SORT_BY_NAME {
+		return MatchListing{}, fmt.Errorf("cannot sort matches by %q", query.SortBy)
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultListingLimit
+	}
+	query.Limit = min(query.Limit, maxListingLimit)
+
+	var after *listingCursor
+	if query.Cursor != "" {
+		cursor, err := decodeListingCursor(query.Cursor)
+		if err != nil {
+			return MatchListing{}, err
+		}
+		if cursor.SortBy != query.SortBy || cursor.Descending != query.Descending {
+			return MatchListing{}, errors.New("cursor was taken with a different ordering")
+		}
+		after = &cursor
+	}
+
+	matches := make([]MatchDescription, 0)
+	for _, match := range h.matches {
+		description := match.Description()
+		if !query.Matches(description) {
+			continue
+		}
+		if after != nil && !after.before(newListingCursor(query, description)) {
+			continue
+		}
+		matches = append(matches, description)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return newListingCursor(query, matches[i]).before(newListingCursor(query, matches[j]))
+	})
+
+	listing := MatchListing{Matches: matches}
+	if len(matches) > query.Limit {
+		listing.Matches = matches[:query.Limit]
+		listing.NextCursor = newListingCursor(query, listing.Matches[query.Limit-1]).Encode()
+	}
+	return listing, nil
+}
+
+// LobbySubscription is a client's filters along with the matches it has been told about
+type LobbySubscription struct {
+	query   ListMatches
+	visible map[string]bool
+}
+
+// LobbyUpdate describes how the matches passing a subscription's filters changed
+type LobbyUpdate struct {
+	Created []MatchDescription `json:"created,omitempty"`
+	Updated []MatchDescription `json:"updated,omitempty"`
+	// GUIDs of matches that ended or no longer pass the filters
+	Removed []string `json:"removed,omitempty"`
+}
+
+func (u LobbyUpdate) Empty() bool {
+	return len(u.Created) == 0 && len(u.Updated) == 0 && len(u.Removed) == 0
+}
+
+func (h *Hub) HandleSubscribeLobby(client *Client, query ListMatches) error {
+	log.Println("Lobby subscription requested...")
+
+	// Anything still pending is already part of the snapshot below
+	h.FlushLobbyChanges()
+
+	subscription := &LobbySubscription{
+		query:   query,
+		visible: make(map[string]bool),
+	}
+	h.subscriptions[client] = subscription
+
+	update := LobbyUpdate{Created: make([]MatchDescription, 0)}
+	for guid, match := range h.matches {
+		description := match.Description()
+		if query.Matches(description) {
+			subscription.visible[guid] = true
+			update.Created = append(update.Created, description)
+		}
+	}
+	return sendLobbyUpdate(client, update)
+}
+
+// LobbyChanged marks the match to be pushed to subscribers on the next flush, it is also used for matches that ended
+func (h *Hub) LobbyChanged(match *Match) {
+	h.lobbyChanges[match.meta.Guid.String()] = match
+}
+
+// FlushLobbyChanges sends every subscriber the changes to the matches it can see since the last flush
+func (h *Hub) FlushLobbyChanges() {
+	if len(h.lobbyChanges) == 0 {
+		return
+	}
+
+	descriptions := make(map[string]MatchDescription)
+	for guid := range h.lobbyChanges {
+		if match := h.matches[guid]; match != nil {
+			descriptions[guid] = match.Description()
+		}
+	}
+
+	for client, subscription := range h.subscriptions {
+		var update LobbyUpdate
+		for guid, match := range h.lobbyChanges {
+			description, exists := descriptions[guid]
+			passes := exists && subscription.query.Matches(description)
+			switch {
+			case passes && subscription.visible[guid]:
+				update.Updated = append(update.Updated, description)
+			case passes:
+				subscription.visible[guid] = true
+				update.Created = append(update.Created, description)
+			case subscription.visible[guid]:
+				delete(subscription.visible, guid)
+				update.Removed = append(update.Removed, base64.StdEncoding.EncodeToString(match.meta.Guid[:]))
+			}
+		}
+		if !update.Empty() {
+			if err := sendLobbyUpdate(client, update); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	clear(h.lobbyChanges)
+}
+
+func sendLobbyUpdate(client *Client, update LobbyUpdate) error {
+	client.Notify(NewNotification(update, RES_ID_LOBBY_UPDATE))
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHasSlotsLeavesOutLockedMatches(t *testing.T) {
+	hub := startHub()
+	open := connect(t, hub, "username=open")
+	locked := connect(t, hub, "username=locked")
+	hostAndJoin(t, open)
+	hostAndJoin(t, locked)
+	locked.Command(map[string]any{"action": LOCK_MATCH, "locked": true})
+	// Locking has no response, a listing after it shows the hub got to it
+	locked.Command(map[string]any{"action": LIST_MATCHES})
+	locked.Expect(RES_ID_COMMAND_RES)
+
+	browser := connect(t, hub, "username=browser")
+	browser.Command(map[string]any{"action": LIST_MATCHES, "has_slots": true})
+	var listing MatchListing
+	if err := json.Unmarshal(browser.Expect(RES_ID_COMMAND_RES)[1:], &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Matches) != 1 || listing.Matches[0].Host != "open" {
+		t.Errorf("listed %+v", listing.Matches)
+	}
+}
+
+// nextLobbyUpdate reads lobby updates until one passes the check, changes can arrive spread over several flushes
+func nextLobbyUpdate(tb testing.TB, client *testClient, check func(LobbyUpdate) bool) LobbyUpdate {
+	tb.Helper()
+	for {
+		var update LobbyUpdate
+		if err := json.Unmarshal(client.Expect(RES_ID_LOBBY_UPDATE)[1:], &update); err != nil {
+			tb.Fatal(err)
+		}
+		if check(update) {
+			return update
+		}
+	}
+}
+
+func TestLobbyDeltas(t *testing.T) {
+	setFlag(t, lobbyUpdateInterval, 10*time.Millisecond)
+	hub := startHub()
+	browser := connect(t, hub, "username=browser")
+	browser.Command(map[string]any{"action": SUBSCRIBE_LOBBY, "region": "eu"})
+	if snapshot := nextLobbyUpdate(t, browser, func(LobbyUpdate) bool { return true }); len(snapshot.Created) != 0 {
+		t.Fatalf("snapshot of an empty lobby %+v", snapshot)
+	}
+
+	host := connect(t, hub, "username=host")
+	host.Command(map[string]any{"action": HOST_MATCH, "region": "eu"})
+	var hosted MatchDescription
+	if err := json.Unmarshal(host.Expect(RES_ID_CONFIRMATION)[2:], &hosted); err != nil {
+		t.Fatal(err)
+	}
+	// Matches outside the filters are never mentioned
+	elsewhere := connect(t, hub, "username=elsewhere")
+	elsewhere.Command(map[string]any{"action": HOST_MATCH, "region": "us"})
+	elsewhere.Expect(RES_ID_CONFIRMATION)
+
+	created := nextLobbyUpdate(t, browser, func(update LobbyUpdate) bool { return len(update.Created) > 0 })
+	if len(created.Created) != 1 || created.Created[0].Guid != hosted.Guid {
+		t.Errorf("created %+v", created.Created)
+	}
+
+	peer := connect(t, hub, "username=peer")
+	peer.Command(map[string]any{"action": JOIN_MATCH, "uuid": hosted.Guid})
+	updated := nextLobbyUpdate(t, browser, func(update LobbyUpdate) bool { return len(update.Updated) > 0 })
+	if len(updated.Updated) != 1 || updated.Updated[0].Players != 2 {
+		t.Errorf("updated %+v", updated.Updated)
+	}
+
+	// Moving out of the filters removes the match
+	host.Command(map[string]any{"action": SET_MATCH_METADATA, "uuid": hosted.Guid, "region": "us"})
+	removed := nextLobbyUpdate(t, browser, func(update LobbyUpdate) bool { return len(update.Removed) > 0 })
+	if len(removed.Removed) != 1 || removed.Removed[0] != hosted.Guid || len(removed.Created)+len(removed.Updated) != 0 {
+		t.Errorf("removed %+v", removed)
+	}
+}
+
+func TestJoiningUnsubscribesFromLobby(t *testing.T) {
+	setFlag(t, lobbyUpdateInterval, 10*time.Millisecond)
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	browser := connect(t, hub, "username=browser")
+	match := hostAndJoin(t, host)
+	browser.Command(map[string]any{"action": SUBSCRIBE_LOBBY})
+	browser.Expect(RES_ID_LOBBY_UPDATE)
+
+	browser.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	host.Expect(RES_ID_PEER_CONNECTED)
+	other := connect(t, hub, "username=other")
+	hostAndJoin(t, other)
+
+	// Several flushes go by without the browser hearing about the new match
+	deadline := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case message := <-browser.transport.written:
+			if message[0] == RES_ID_LOBBY_UPDATE {
+				t.Fatalf("got a lobby update after joining: %q", message)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
@@ -1,25 +1,157 @@
 package main
 
 import (
+	"compress/flate"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
-var addr = flag.String("addr", ":1234", "http service address")
+var (
+	addr    = flag.String("addr", ":1234", "http service address")
+	tcpAddr = flag.String("tcp-addr", "", "address to accept raw tcp clients on, tcp is disabled without one")
+	udpAddr = flag.String("udp-addr", "", "address to accept unreliable relay traffic on over udp, udp is disabled without one")
+
+	minProtocolVersion = flag.Int("min-protocol-version", MIN_PROTOCOL_VERSION, "oldest protocol version clients may connect with")
+
+	maxCommandSize     = flag.Int("max-command-size", 4096, "largest server command in bytes, larger ones are rejected with an error")
+	maxRelaySize       = flag.Int("max-relay-size", 64*1024, "largest relay packet in bytes, larger ones are rejected with an error")
+	maxFrameSize       = flag.Int64("max-frame-size", 4*1024*1024, "largest websocket frame in bytes before the connection is dropped")
+	fragmentation      = flag.Bool("fragmentation", false, "accept fragmented messages and fragment large outbound messages for clients with the fragmentation capability")
+	fragmentSize       = flag.Int("fragment-size", 16*1024, "outbound messages larger than this are split into fragments")
+	maxReassembledSize = flag.Int("max-reassembled-size", 1024*1024, "largest message that can be reassembled from fragments")
+
+	compression          = flag.Bool("compression", false, "negotiate permessage-deflate with clients that offer it")
+	compressionLevel     = flag.Int("compression-level", flate.BestSpeed, "flate compression level, from -2 to 9")
+	compressionThreshold = flag.Int("compression-threshold", 256, "outbound messages smaller than this are sent uncompressed")
+
+	queueTimeout        = flag.Duration("queue-timeout", 2*time.Minute, "longest a client can wait in the matchmaking queue")
+	matchmakingInterval = flag.Duration("matchmaking-interval", time.Second, "how often the matchmaker tries to group queued clients")
+	ratingWindow        = flag.Float64("rating-window", 200, "largest rating difference between clients placed in the same match")
+	ratingWindowGrowth  = flag.Float64("rating-window-growth", 10, "how much the rating window widens for every second a client waits")
+	maxRatingWindow     = flag.Float64("max-rating-window", 1000, "the rating window stops widening at this difference")
+	maxMatchSize        = flag.Int("max-match-size", 16, "largest match size a client can queue for")
+
+	lobbyUpdateInterval = flag.Duration("lobby-update-interval", time.Second, "how often lobby changes are pushed to subscribed clients")
+	rttInterval         = flag.Duration("rtt-interval", 5*time.Second, "how often clients are pinged to measure their round trip time")
+	serverTimeInterval  = flag.Duration("server-time-interval", 0, "how often match members are sent the server time, never when 0")
+
+	maxSpectators  = flag.Int("max-spectators", 16, "most spectators a match can have, they don't count toward its players")
+	spectatorDelay = flag.Duration("spectator-delay", 0, "how long broadcast relay traffic is held back before spectators receive it")
+
+	recordDir     = flag.String("record-dir", "", "directory matches opting in are recorded to, recording is disabled without one")
+	dumpRecording = flag.String("dump-recording", "", "print the records of a recording as JSON lines and exit")
+
+	moderationStore = flag.String("moderation-store", MODERATION_STORE_MEMORY, "where bans and reports are kept: memory, file or redis")
+	moderationFile  = flag.String("moderation-file", "moderation.json", "file the file moderation store keeps bans in")
+	reportsFile     = flag.String("reports-file", "reports.jsonl", "file the file moderation store appends reports to, one JSON object a line")
+	redisConfig     = flag.String("redis-config", "debug.ini", "ini file whose [redis] section has the host, port, username and password of the redis moderation store")
+	trustProxy      = flag.Bool("trust-proxy", false, "take client IPs from X-Forwarded-For, only safe behind a proxy that sets it")
+	adminTokenFile  = flag.String("admin-token-file", "", "file holding the bearer token for the admin API, "+ADMIN_TOKEN_ENV+" is used when not set, the admin API is disabled without either")
+
+	maxStateKeys = flag.Int("max-state-keys", 256, "most keys a match's shared state can hold")
+	maxTickRate  = flag.Int("max-tick-rate", 60, "highest tick rate a host can batch its match's relay packets at")
+
+	resumeWindow = flag.Duration("resume-window", 0, "how long a disconnected client can resume its session, resuming is disabled when 0")
+
+	chatRate        = flag.Float64("chat-rate", 1, "chat messages a client can send per second")
+	chatBurst       = flag.Int("chat-burst", 5, "chat messages a client can send at once before being rate limited")
+	maxChatLength   = flag.Int("max-chat-length", 256, "longest chat message in characters")
+	chatHistorySize = flag.Int("chat-history", 20, "match chat messages kept for clients that join later")
+	chatFilterWords = flag.String("chat-filter-words", "", "file of words masked out of chat, one per line")
+
+	simulateMatchmaking   = flag.Bool("simulate-matchmaking", false, "print a report from an offline matchmaking simulation and exit")
+	simulationSeed        = flag.Int64("simulation-seed", 1, "seed for the simulated population")
+	simulationPlayers     = flag.Int("simulation-players", 1000, "number of simulated players to queue")
+	simulationArrivalRate = flag.Float64("simulation-arrival-rate", 2, "simulated players queueing per second")
+	simulationMatchSize   = flag.Int("simulation-match-size", 4, "match size the simulated players queue for")
+	simulationTeams       = flag.Int("simulation-teams", 2, "number of teams the simulated players queue for")
+)
 
 func main() {
 	log.Println("Starting server...")
 	flag.Parse()
+	if *fragmentation && *fragmentSize <= 0 {
+		log.Fatal("fragment-size must be positive when fragmentation is enabled")
+	}
+	if *compressionLevel < flate.HuffmanOnly || *compressionLevel > flate.BestCompression {
+		log.Fatal("compression-level must be between -2 and 9")
+	}
+	upgrader.EnableCompression = *compression
+
+	if *simulateMatchmaking {
+		if *simulationTeams < 1 || *simulationMatchSize%*simulationTeams != 0 {
+			log.Fatal("simulation-match-size must divide evenly into simulation-teams")
+		}
+		report := SimulateMatchmaking(*simulationSeed, *simulationPlayers, *simulationArrivalRate, QueueMatch{
+			MatchSize: *simulationMatchSize,
+			Teams:     *simulationTeams,
+		})
+		output, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(output))
+		return
+	}
+
+	if *dumpRecording != "" {
+		if err := DumpRecording(*dumpRecording); err != nil {
+			log.Fatal("Could not dump recording: ", err)
+		}
+		return
+	}
+	if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0755); err != nil {
+			log.Fatal("Could not create the recording directory: ", err)
+		}
+	}
+
 	hub := NewHub()
+	if filter, err := LoadWordListFilter(*chatFilterWords); err != nil {
+		log.Fatal("Could not load chat filter words: ", err)
+	} else {
+		hub.chatFilter = filter
+	}
+	if store, err := NewModerationStore(*moderationStore); err != nil {
+		log.Fatal("Could not open the moderation store: ", err)
+	} else {
+		hub.moderation = store
+	}
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			log.Fatal("Could not listen for udp traffic: ", err)
+		}
+		hub.udp = NewUDPServer(conn)
+		go hub.udp.Serve()
+	}
 	go hub.run()
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	go hub.matchmaker.run()
+	if *tcpAddr != "" {
+		listener, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatal("Could not listen for tcp clients: ", err)
+		}
+		go ServeTCP(hub, listener)
+	}
+	// expvar registers /debug/vars on the default mux, so the server uses its own and the metrics are served behind the admin API
+	mux := http.NewServeMux()
+	if token, err := LoadAdminToken(*adminTokenFile); err != nil {
+		log.Fatal("Could not read the admin token: ", err)
+	} else if token != "" {
+		hub.adminToken = token
+		mux.HandleFunc("/admin/", hub.ServeAdmin)
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Hitting")
 		serveWs(hub, w, r)
 	})
 	server := &http.Server{
 		Addr:              *addr,
+		Handler:           mux,
 		ReadHeaderTimeout: 3 * time.Second,
 	}
 	err := server.ListenAndServe()
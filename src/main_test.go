@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Every command and connection is logged, which drowns out test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// pipeTransport is an in-memory transport, tests write what the client sends to inbound and read what the server sent from written
+type pipeTransport struct {
+	inbound chan []byte
+	written chan []byte
+	// Writes block while stalled, and fail once released
+	stallMu sync.Mutex
+	stalled chan struct{}
+	// Writes block while paused, and go through once resumed
+	paused chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeTransport() *pipeTransport {
+	return &pipeTransport{
+		inbound: make(chan []byte),
+		written: make(chan []byte, 1024),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Stall blocks the server's writes, as a client that stopped reading would, until the returned function fails them
+func (t *pipeTransport) Stall() (fail func()) {
+	stalled := make(chan struct{})
+	t.stallMu.Lock()
+	t.stalled = stalled
+	t.stallMu.Unlock()
+	return func() { close(stalled) }
+}
+
+// Pause blocks the server's writes until the returned function lets them through
+func (t *pipeTransport) Pause() (resume func()) {
+	paused := make(chan struct{})
+	t.stallMu.Lock()
+	t.paused = paused
+	t.stallMu.Unlock()
+	return func() { close(paused) }
+}
+
+func (t *pipeTransport) NextReader() (io.Reader, error) {
+	select {
+	case message := <-t.inbound:
+		return bytes.NewReader(message), nil
+	case <-t.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *pipeTransport) WriteMessage(message []byte) error {
+	t.stallMu.Lock()
+	stalled, paused := t.stalled, t.paused
+	t.stallMu.Unlock()
+	if paused != nil {
+		<-paused
+	}
+	if stalled != nil {
+		<-stalled
+		return errors.New("write timed out")
+	}
+	select {
+	case t.written <- message:
+		return nil
+	case <-t.closed:
+		return net.ErrClosed
+	}
+}
+
+func (t *pipeTransport) Ping(payload []byte) error                   { return nil }
+func (t *pipeTransport) SetPongHandler(handler func(payload []byte)) {}
+func (t *pipeTransport) SetReadDeadline(deadline time.Time) error    { return nil }
+func (t *pipeTransport) SetWriteDeadline(deadline time.Time) error   { return nil }
+func (t *pipeTransport) WriteClose() error                           { return nil }
+
+func (t *pipeTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+func startHub() *Hub {
+	hub := NewHub()
+	go hub.run()
+	go hub.matchmaker.run()
+	return hub
+}
+
+type testClient struct {
+	tb        testing.TB
+	transport *pipeTransport
+	// Base64 GUID from the connected confirmation, as relay packets address the client
+	id string
+	// The whole connected confirmation
+	connected []byte
+}
+
+// connect connects a client with the query parameters, reading its connected confirmation
+func connect(tb testing.TB, hub *Hub, query string) *testClient {
+	tb.Helper()
+	return connectFrom(tb, hub, query, "127.0.0.1")
+}
+
+// connectFrom connects a client from the IP
+func connectFrom(tb testing.TB, hub *Hub, query string, ip string) *testClient {
+	tb.Helper()
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	request, refusal := hub.Admit(values, ip)
+	if refusal != nil {
+		tb.Fatalf("connection refused: %v", refusal.Reason)
+	}
+	client := &testClient{tb: tb, transport: newPipeTransport()}
+	hub.Connect(request, client.transport, false)
+
+	connected := client.Expect(RES_ID_CONFIRMATION)
+	if connected[1] != CONF_CONNECTED {
+		tb.Fatalf("expected the connected confirmation, got %q", connected)
+	}
+	client.id = string(connected[2:26])
+	client.connected = connected
+	return client
+}
+
+func (c *testClient) Write(message []byte) {
+	c.transport.inbound <- message
+}
+
+func (c *testClient) Command(command map[string]any) {
+	encoded, err := json.Marshal(command)
+	if err != nil {
+		c.tb.Fatal(err)
+	}
+	c.Write(append([]byte{CMD_PREFIX}, encoded...))
+}
+
+func (c *testClient) Read() []byte {
+	c.tb.Helper()
+	select {
+	case message := <-c.transport.written:
+		return message
+	case <-time.After(2 * time.Second):
+		c.tb.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+// Expect reads until a message with the response ID, skipping the ones before it
+func (c *testClient) Expect(resID byte) []byte {
+	c.tb.Helper()
+	for {
+		if message := c.Read(); len(message) > 0 && message[0] == resID {
+			return message
+		}
+	}
+}
+
+// hostAndJoin has the host host a match and the peers join it, returning the match's GUID
+func hostAndJoin(tb testing.TB, host *testClient, peers ...*testClient) string {
+	tb.Helper()
+	host.Command(map[string]any{"action": HOST_MATCH})
+	hosted := host.Expect(RES_ID_CONFIRMATION)
+	var description MatchDescription
+	if err := json.Unmarshal(hosted[2:], &description); err != nil {
+		tb.Fatalf("could not read the hosted match %q: %v", hosted, err)
+	}
+	for _, peer := range peers {
+		peer.Command(map[string]any{"action": JOIN_MATCH, "uuid": description.Guid})
+		host.Expect(RES_ID_PEER_CONNECTED)
+	}
+	return description.Guid
+}
+
+// setFlag changes a flag for the length of the test
+func setFlag[T any](tb testing.TB, flag *T, value T) {
+	old := *flag
+	*flag = value
+	tb.Cleanup(func() { *flag = old })
+}
@@ -1,6 +1,12 @@
 package main
 
-import "github.com/google/uuid"
+import (
+	"encoding/base64"
+	"github.com/google/uuid"
+	"log"
+	"sync"
+	"time"
+)
 
 type MatchMessage struct {
 	Action string     `json:"action"`
@@ -8,9 +14,17 @@ type MatchMessage struct {
 }
 
 type MatchData struct {
-	Guid uuid.UUID `json:"guid,omitempty"`
-	Name string    `json:"name,omitempty"`
-	//State   string `json:"state,omitempty"`
+	Guid       uuid.UUID         `json:"guid,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Code       string            `json:"code,omitempty"`
+	State      string            `json:"state,omitempty"`
+	Region     string            `json:"region,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Created    time.Time         `json:"created,omitempty"`
+	Recording  bool              `json:"recording,omitempty"`
+	// Relay packets are batched into one frame per recipient this many times a second, 0 sends each packet as it comes
+	TickRate int `json:"tick_rate,omitempty"`
 	//Private bool   `json:"private,omitempty"`
 	//Key     string `json:"key,omitempty"`
 }
@@ -24,25 +38,375 @@ const (
 )
 
 type Match struct {
-	host       *Client
+	// Nil for replays, which have no players
+	host *Client
+	// clients is written by the hub and read by the match goroutine, so it is guarded by mu
+	mu         sync.RWMutex
 	clients    map[string]*Client // guid -> client
+	teams      map[string]int     // guid -> team, only for clients placed on a team
+	peerIDs    map[string]int32   // guid -> Godot multiplayer peer ID, see webrtc.go
+	nextPeerID int32
 	maxClients int
+	// Spectators watch the match without taking part, they don't count toward maxClients
+	spectators     map[string]*Client // guid -> client
+	maxSpectators  int
+	spectatorDelay time.Duration
+	// Broadcast relay packets waiting out the spectator delay
+	spectatorFeed chan spectatorPacket
+	// Recent match chat, only used from the hub goroutine
+	chatHistory ChatHistory
+	// Shared key/value state, only used from the hub goroutine
+	state *MatchState
+	// Nil unless the match is being recorded
+	recorder *Recorder
+	// Replays stream a recording to spectators and have no players
+	replay bool
+	// Set by the host, see hostcontrols.go. Mutes are read by the match goroutine so they are guarded by mu, the rest belong to the hub goroutine
+	locked bool
+	banned map[string]string   // banned IP -> identity it was banned under
+	mutes  map[string]PeerMute // guid -> mute
+	// Relay packets waiting for the next tick, only used from the match goroutine
+	batches map[*Client][]byte
 
+	// meta is only written by the hub, which reads it freely, other goroutines read it under mu
 	meta MatchData
 
 	register   chan *Client
 	unregister chan *Client
-	broadcast  chan []byte
-	end        chan bool
+	broadcast  chan *Notification
+	relay      chan struct {
+		RawMessage
+		*Client
+	}
+	end chan bool
+	// Closed when the run loop exits so pending relays don't block forever
+	stopped chan struct{}
+}
+
+type spectatorPacket struct {
+	deliverAt time.Time
+	packet    []byte
+}
+
+// spectatorFeedSize is how many delayed packets a match holds before dropping spectator traffic
+const spectatorFeedSize = 1024
+
+// relayBufferSize is how many relay packets wait on the match goroutine before UDP starts dropping them
+const relayBufferSize = 256
+
+func NewMatch(meta MatchData, host *Client, maxClients int) *Match {
+	clients := make(map[string]*Client)
+	clients[host.guid.String()] = host
+
+	return &Match{
+		meta:       meta,
+		host:       host,
+		clients:    clients,
+		teams:      make(map[string]int),
+		peerIDs:    map[string]int32{host.guid.String(): TARGET_PEER_HOST},
+		nextPeerID: TARGET_PEER_HOST + 1,
+		state:      NewMatchState(),
+		banned:     make(map[string]string),
+		mutes:      make(map[string]PeerMute),
+		batches:    make(map[*Client][]byte),
+		maxClients: maxClients,
+
+		spectators:     make(map[string]*Client),
+		maxSpectators:  *maxSpectators,
+		spectatorDelay: *spectatorDelay,
+		spectatorFeed:  make(chan spectatorPacket, spectatorFeedSize),
+
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan *Notification),
+		relay: make(chan struct {
+			RawMessage
+			*Client
+		}, relayBufferSize),
+		end:     make(chan bool),
+		stopped: make(chan struct{}),
+	}
+}
+
+// AddClients adds every client to the match, or none of them if the match lacks room for all of them
+func (m *Match) AddClients(clients []*Client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.clients)+len(clients) > m.maxClients {
+		return false
+	}
+	for _, client := range clients {
+		m.clients[client.guid.String()] = client
+		m.peerIDs[client.guid.String()] = m.nextPeerID
+		m.nextPeerID++
+	}
+	return true
+}
+
+// RemoveClient removes the client from the match and returns the number of clients left
+func (m *Match) RemoveClient(client *Client) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.clients, client.guid.String())
+	delete(m.teams, client.guid.String())
+	delete(m.peerIDs, client.guid.String())
+	return len(m.clients)
+}
+
+// ReplaceClient puts a client that resumed its session in place of its old connection, as a player or spectator
+func (m *Match) ReplaceClient(client *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	guid := client.guid.String()
+	if m.clients[guid] != nil {
+		m.clients[guid] = client
+	}
+	if m.spectators[guid] != nil {
+		m.spectators[guid] = client
+	}
+}
+
+// AddSpectator adds the client as a spectator, returns false if the match has no room for another spectator
+func (m *Match) AddSpectator(client *Client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.spectators) >= m.maxSpectators {
+		return false
+	}
+	m.spectators[client.guid.String()] = client
+	return true
+}
+
+// RemoveSpectator removes the client from the spectators, returns false if it wasn't spectating
+func (m *Match) RemoveSpectator(client *Client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.spectators[client.guid.String()] == nil {
+		return false
+	}
+	delete(m.spectators, client.guid.String())
+	return true
+}
+
+// Spectator looks up a spectator of the match by GUID, returns nil if they aren't spectating
+func (m *Match) Spectator(guid string) *Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.spectators[guid]
+}
+
+// Spectators returns a snapshot of the current spectators of the match
+func (m *Match) Spectators() []*Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	spectators := make([]*Client, 0, len(m.spectators))
+	for _, spectator := range m.spectators {
+		spectators = append(spectators, spectator)
+	}
+	return spectators
+}
+
+// SetTeam places a member of the match on a team
+func (m *Match) SetTeam(client *Client, team int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.teams[client.guid.String()] = team
+}
+
+// Team returns the client's team, ok is false if the client isn't on a team of this match or the match is nil
+func (m *Match) Team(client *Client) (team int, ok bool) {
+	if m == nil {
+		return 0, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	team, ok = m.teams[client.guid.String()]
+	return team, ok
+}
+
+// Client looks up a member of the match by GUID, returns nil if they aren't in the match
+func (m *Match) Client(guid string) *Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.clients[guid]
+}
+
+// Clients returns a snapshot of the current members of the match
+func (m *Match) Clients() []*Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(m.clients))
+	for _, client := range m.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Name returns the match name, for goroutines other than the hub
+func (m *Match) Name() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.meta.Name
+}
+
+// Description summarizes the match for lobby listings
+func (m *Match) Description() MatchDescription {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	host := ""
+	if m.host != nil {
+		host = m.host.username
+	}
+	return MatchDescription{
+		Name:          m.meta.Name,
+		Code:          m.meta.Code,
+		Guid:          base64.StdEncoding.EncodeToString(m.meta.Guid[:]),
+		Players:       len(m.clients),
+		MaxPlayers:    m.maxClients,
+		Spectators:    len(m.spectators),
+		MaxSpectators: m.maxSpectators,
+		Host:          host,
+		State:         m.meta.State,
+		Region:        m.meta.Region,
+		Tags:          m.meta.Tags,
+		Properties:    m.meta.Properties,
+		Created:       m.meta.Created.Unix(),
+		Recording:     m.meta.Recording,
+		Locked:        m.locked,
+		TickRate:      m.meta.TickRate,
+		Replay:        m.replay,
+	}
+}
+
+// Relay hands a relay packet to the match goroutine
+func (m *Match) Relay(message []byte, client *Client) {
+	select {
+	case m.relay <- struct {
+		RawMessage
+		*Client
+	}{message, client}:
+	case <-m.stopped:
+	}
+}
+
+// TryRelay hands a relay packet to the match goroutine without waiting, returns false if the packet was dropped
+func (m *Match) TryRelay(message []byte, client *Client) bool {
+	select {
+	case m.relay <- struct {
+		RawMessage
+		*Client
+	}{message, client}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Broadcast sends a notification to every player and spectator of the match, the caller must not touch it afterwards
+func (m *Match) Broadcast(message *Notification) {
+	select {
+	case m.broadcast <- message:
+	case <-m.stopped:
+	}
+}
+
+// Stop ends the run loop of the match
+func (m *Match) Stop() {
+	select {
+	case m.end <- true:
+	case <-m.stopped:
+	}
 }
 
 func (m *Match) run() {
+	defer close(m.stopped)
+	if m.spectatorDelay > 0 {
+		go m.runSpectatorFeed()
+	}
+	// Left nil, and never ready, when the match doesn't tick
+	var ticks <-chan time.Time
+	if m.meta.TickRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(m.meta.TickRate))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var serverTimes <-chan time.Time
+	if *serverTimeInterval > 0 {
+		serverTimeTicker := time.NewTicker(*serverTimeInterval)
+		defer serverTimeTicker.Stop()
+		serverTimes = serverTimeTicker.C
+	}
 	for {
 		select {
+		case <-ticks:
+			m.FlushBatches()
+		case now := <-serverTimes:
+			m.SendServerTime(now)
 		case broadcast := <-m.broadcast:
-			for _, client := range m.clients {
-				client.send <- broadcast
+			for _, client := range m.Clients() {
+				client.Notify(broadcast)
+			}
+			for _, spectator := range m.Spectators() {
+				spectator.Notify(broadcast)
+			}
+		case packet := <-m.relay:
+			if m.Spectator(packet.Client.guid.String()) != nil {
+				log.Printf("Dropping relay message from %v, spectators cannot relay", packet.Client.username)
+				packet.Client.SendError(ERR_SPECTATING, "Spectators cannot send relay messages")
+				continue
+			}
+			if m.Mute(packet.Client).Relay {
+				log.Printf("Dropping relay message from %v, muted by the host", packet.Client.username)
+				continue
+			}
+			prefix, message := packet.RawMessage[0], packet.RawMessage[1:]
+			var senderSeq uint32
+			var channel byte
+			var err error
+			switch prefix {
+			case RELIABLE_PREFIX:
+				message, senderSeq, err = SplitReliableMessage(message)
+			case LATEST_PREFIX:
+				message, channel, err = SplitLatestMessage(message)
+			}
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			relayMessage, err := m.SplitRelayMessage(message, packet.Client)
+			if err != nil {
+				log.Println(err)
+				if prefix == RELIABLE_PREFIX {
+					packet.Client.reliable.Send(receipt(RECEIPT_FAILED, senderSeq, uuid.Nil))
+				}
+				continue
 			}
+			switch prefix {
+			case RELIABLE_PREFIX:
+				err = m.HandleReliableMessage(relayMessage, packet.Client, senderSeq)
+			case LATEST_PREFIX:
+				err = m.HandleLatestMessage(relayMessage, packet.Client, channel)
+			default:
+				err = m.HandleRelayMessage(relayMessage, packet.Client)
+			}
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			m.recorder.Record(RECORD_RELAY, packet.Client.guid, relayMessage.PeerID, message[relayPeerIDSize:])
 		case end := <-m.end:
 			if end {
 				return
@@ -51,6 +415,43 @@ func (m *Match) run() {
 	}
 }
 
+// SendToSpectators hands a broadcast relay packet to the spectators, holding it back for the spectator delay if there is one
+func (m *Match) SendToSpectators(packet []byte) {
+	if m.spectatorDelay <= 0 {
+		for _, spectator := range m.Spectators() {
+			spectator.Send(packet)
+		}
+		return
+	}
+
+	select {
+	case m.spectatorFeed <- spectatorPacket{deliverAt: time.Now().Add(m.spectatorDelay), packet: packet}:
+	default:
+		log.Printf("Spectator feed of match %v is full, dropping packet", m.Name())
+	}
+}
+
+// runSpectatorFeed delivers delayed packets in the order they were relayed until the match stops
+func (m *Match) runSpectatorFeed() {
+	for {
+		var next spectatorPacket
+		select {
+		case next = <-m.spectatorFeed:
+		case <-m.stopped:
+			return
+		}
+
+		select {
+		case <-time.After(time.Until(next.deliverAt)):
+		case <-m.stopped:
+			return
+		}
+		for _, spectator := range m.Spectators() {
+			spectator.Send(next.packet)
+		}
+	}
+}
+
 //func (c *Client) HostMatch(name string) (*Match, error) {
 //	guid, err := uuid.NewUUID()
 //	if err != nil {
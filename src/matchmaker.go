@@ -0,0 +1,394 @@
+/** The matchmaker groups queued clients into matches so players don't have to browse for one
+
+Clients queue with a game mode, region, match size and team count, and optionally a skill rating.
+Tickets are only grouped with tickets that share all four, and whose rating is close enough when both carry one.
+The acceptable rating gap widens the longer a ticket waits, and teams are balanced by their total rating.
+A party queues as a single ticket from its leader, and its members are always placed on the same team.
+A ticket leaves the queue when its match is found, when its client cancels or disconnects, or when it times out.
+
+There is no authenticated identity to take ratings from yet, so they are provided by the client when queueing.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Ticket is a single client or party waiting in the matchmaking queue
+type Ticket struct {
+	// The client that queued, and everyone in its party including itself
+	client   *Client
+	members  []*Client
+	criteria QueueMatch
+	queued   time.Time
+	expires  time.Time
+	// Assigned once the ticket is grouped
+	team int
+}
+
+// key groups tickets that could ever be placed in the same match
+func (t *Ticket) key() string {
+	return fmt.Sprintf("%s|%s|%d|%d", t.criteria.GameMode, t.criteria.Region, t.criteria.MatchSize, t.criteria.Teams)
+}
+
+// size is the number of players the ticket brings, simulated tickets have no members and count as one
+func (t *Ticket) size() int {
+	return max(1, len(t.members))
+}
+
+// Send sends every member of the ticket a message
+func (t *Ticket) Send(message []byte) {
+	for _, member := range t.members {
+		member.Send(message)
+	}
+}
+
+// Notify notifies every member of the ticket
+func (t *Ticket) Notify(notification *Notification) {
+	for _, member := range t.members {
+		member.Notify(notification)
+	}
+}
+
+// rating falls back to the default rating for tickets queued without one
+func (t *Ticket) rating() float64 {
+	if t.criteria.Rating == nil {
+		return defaultRating
+	}
+	return *t.criteria.Rating
+}
+
+// window is the rating gap the ticket accepts, it widens with the time spent waiting
+func (t *Ticket) window(now time.Time) float64 {
+	return min(*ratingWindow+*ratingWindowGrowth*now.Sub(t.queued).Seconds(), *maxRatingWindow)
+}
+
+// compatible reports whether the ticket could share a match with another, tickets without a rating match anyone
+func (t *Ticket) compatible(other *Ticket, now time.Time) bool {
+	if t.criteria.Rating == nil || other.criteria.Rating == nil {
+		return true
+	}
+	return math.Abs(*t.criteria.Rating-*other.criteria.Rating) <= max(t.window(now), other.window(now))
+}
+
+// defaultRating stands in for tickets without a rating when teams are balanced
+const defaultRating = 1000
+
+// waitSmoothing is the weight of the newest wait in the estimated wait time average
+const waitSmoothing = 0.2
+
+type QueueStatus struct {
+	GameMode  string `json:"game_mode"`
+	Region    string `json:"region"`
+	MatchSize int    `json:"match_size"`
+	Teams     int    `json:"teams"`
+	Timeout   int    `json:"timeout"`
+	// Seconds, based on how long recent matches with the same criteria took to form, omitted until there are any
+	EstimatedWait int `json:"estimated_wait,omitempty"`
+}
+
+type MatchFound struct {
+	Name string `json:"name"`
+	Guid string `json:"guid"`
+	Host string `json:"host"`
+	// The team of the receiving client, and the client UUIDs on every team
+	Team  int        `json:"team"`
+	Teams [][]string `json:"teams"`
+}
+
+type Matchmaker struct {
+	hub *Hub
+	// Tickets in the order they were queued, the oldest ticket gets first pick
+	tickets []*Ticket
+	// Smoothed time to form a match, by ticket key
+	waits map[string]time.Duration
+
+	enqueue chan *Ticket
+	requeue chan *Ticket
+	cancel  chan *Client
+}
+
+func NewMatchmaker(hub *Hub) *Matchmaker {
+	return &Matchmaker{
+		hub:     hub,
+		tickets: make([]*Ticket, 0),
+		waits:   make(map[string]time.Duration),
+		enqueue: make(chan *Ticket),
+		requeue: make(chan *Ticket),
+		cancel:  make(chan *Client),
+	}
+}
+
+// Queue puts the party in the queue under its first member, replacing any ticket that member already had
+func (m *Matchmaker) Queue(members []*Client, criteria QueueMatch) {
+	now := time.Now()
+	timeout := *queueTimeout
+	if criteria.Timeout > 0 && time.Duration(criteria.Timeout)*time.Second < timeout {
+		timeout = time.Duration(criteria.Timeout) * time.Second
+	}
+
+	m.enqueue <- &Ticket{
+		client:   members[0],
+		members:  members,
+		criteria: criteria,
+		queued:   now,
+		expires:  now.Add(timeout),
+	}
+}
+
+// Requeue puts a ticket whose match fell through back in the queue, keeping its place and the time it has waited
+func (m *Matchmaker) Requeue(ticket *Ticket) {
+	m.requeue <- ticket
+}
+
+// Cancel takes the client out of the queue, it is a noop for clients that aren't queued
+func (m *Matchmaker) Cancel(client *Client) {
+	m.cancel <- client
+}
+
+func (m *Matchmaker) run() {
+	ticker := time.NewTicker(*matchmakingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ticket := <-m.enqueue:
+			m.insert(ticket)
+			log.Printf("Queued %v for %v players of %q in %q", ticket.client.username, ticket.criteria.MatchSize, ticket.criteria.GameMode, ticket.criteria.Region)
+
+			ticket.Notify(NewNotification(QueueStatus{
+				GameMode:      ticket.criteria.GameMode,
+				Region:        ticket.criteria.Region,
+				MatchSize:     ticket.criteria.MatchSize,
+				Teams:         ticket.criteria.Teams,
+				Timeout:       int(time.Until(ticket.expires).Seconds()),
+				EstimatedWait: int(m.waits[ticket.key()].Seconds()),
+			}, RES_ID_CONFIRMATION, CONF_QUEUED))
+		case ticket := <-m.requeue:
+			// The clients were never told about the match, so as far as they know they are still queued
+			m.insert(ticket)
+			log.Printf("Requeued %v after its match fell through", ticket.client.username)
+		case client := <-m.cancel:
+			if ticket := m.remove(client); ticket != nil {
+				log.Printf("Cancelled queue for %v", client.username)
+				ticket.Send([]byte{RES_ID_CONFIRMATION, CONF_QUEUE_CANCELLED})
+			}
+		case <-ticker.C:
+			now := time.Now()
+			for _, ticket := range m.expire(now) {
+				log.Printf("Queue timed out for %v", ticket.client.username)
+				ticket.Send([]byte{RES_ID_CONFIRMATION, CONF_QUEUE_TIMEOUT})
+			}
+			for _, group := range m.form(now) {
+				// The hub may be waiting to cancel a ticket with us, so don't block on it
+				go func(group []*Ticket) { m.hub.matchmade <- group }(group)
+			}
+		}
+	}
+}
+
+// insert queues the ticket by the time it was first queued, replacing any ticket its client already had
+func (m *Matchmaker) insert(ticket *Ticket) {
+	m.remove(ticket.client)
+	i := slices.IndexFunc(m.tickets, func(queued *Ticket) bool { return queued.queued.After(ticket.queued) })
+	if i == -1 {
+		i = len(m.tickets)
+	}
+	m.tickets = slices.Insert(m.tickets, i, ticket)
+}
+
+// remove drops and returns the client's ticket, returns nil if it had none
+func (m *Matchmaker) remove(client *Client) *Ticket {
+	for i, ticket := range m.tickets {
+		if ticket.client == client {
+			m.tickets = append(m.tickets[:i], m.tickets[i+1:]...)
+			return ticket
+		}
+	}
+	return nil
+}
+
+// expire drops and returns the tickets that have waited too long
+func (m *Matchmaker) expire(now time.Time) []*Ticket {
+	expired := make([]*Ticket, 0)
+	remaining := m.tickets[:0]
+	for _, ticket := range m.tickets {
+		if now.After(ticket.expires) {
+			expired = append(expired, ticket)
+			continue
+		}
+		remaining = append(remaining, ticket)
+	}
+	m.tickets = remaining
+	return expired
+}
+
+// form greedily fills groups starting from the oldest ticket, then takes every full group out of the queue
+func (m *Matchmaker) form(now time.Time) [][]*Ticket {
+	groups := make([][]*Ticket, 0)
+	grouped := make(map[*Ticket]bool)
+	for i, anchor := range m.tickets {
+		if grouped[anchor] {
+			continue
+		}
+
+		group := []*Ticket{anchor}
+		players := anchor.size()
+		for _, candidate := range m.tickets[i+1:] {
+			if players == anchor.criteria.MatchSize {
+				break
+			}
+			if grouped[candidate] || candidate.key() != anchor.key() || players+candidate.size() > anchor.criteria.MatchSize {
+				continue
+			}
+
+			fits := true
+			for _, member := range group {
+				if !member.compatible(candidate, now) {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				group = append(group, candidate)
+				players += candidate.size()
+			}
+		}
+
+		if players < anchor.criteria.MatchSize || !balanceTeams(group, anchor.criteria.Teams) {
+			continue
+		}
+		for _, ticket := range group {
+			grouped[ticket] = true
+		}
+		m.recordWait(anchor.key(), now.Sub(anchor.queued))
+		groups = append(groups, group)
+	}
+
+	remaining := m.tickets[:0]
+	for _, ticket := range m.tickets {
+		if !grouped[ticket] {
+			remaining = append(remaining, ticket)
+		}
+	}
+	m.tickets = remaining
+	return groups
+}
+
+func (m *Matchmaker) recordWait(key string, wait time.Duration) {
+	if previous, ok := m.waits[key]; ok {
+		wait = time.Duration(waitSmoothing*float64(wait) + (1-waitSmoothing)*float64(previous))
+	}
+	m.waits[key] = wait
+}
+
+// balanceTeams assigns the largest then strongest remaining ticket to the weakest team that still has room for it
+// Returns false if the parties can't be packed into teams of equal size
+func balanceTeams(group []*Ticket, teams int) bool {
+	sorted := make([]*Ticket, len(group))
+	copy(sorted, group)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].size() != sorted[j].size() {
+			return sorted[i].size() > sorted[j].size()
+		}
+		return sorted[i].rating() > sorted[j].rating()
+	})
+
+	players := 0
+	for _, ticket := range group {
+		players += ticket.size()
+	}
+	size := players / teams
+	totals := make([]float64, teams)
+	counts := make([]int, teams)
+	for _, ticket := range sorted {
+		team := -1
+		for i := range totals {
+			if counts[i]+ticket.size() <= size && (team == -1 || totals[i] < totals[team]) {
+				team = i
+			}
+		}
+		if team == -1 {
+			return false
+		}
+		ticket.team = team
+		totals[team] += ticket.rating() * float64(ticket.size())
+		counts[team] += ticket.size()
+	}
+	return true
+}
+
+// HandleMatchmade creates the match for a group formed by the matchmaker, the longest waiting client hosts
+func (h *Hub) HandleMatchmade(group []*Ticket) {
+	complete := make([]*Ticket, 0, len(group))
+	for _, ticket := range group {
+		// Clients may have disconnected or left the party while the group was handed over
+		members, err := h.PartyMembers(ticket.client)
+		_, detached := h.detached[ticket.client]
+		if h.clients[ticket.client.guid.String()] == ticket.client && !detached && err == nil && slices.Equal(members, ticket.members) {
+			complete = append(complete, ticket)
+		}
+	}
+	if len(complete) < len(group) {
+		log.Println("Matchmade group lost a client, requeueing the rest")
+		for _, ticket := range complete {
+			h.matchmaker.Requeue(ticket)
+		}
+		return
+	}
+
+	host := group[0].client
+	criteria := group[0].criteria
+	match, err := h.CreateMatch(host, MatchData{
+		Region:     criteria.Region,
+		Properties: map[string]string{"game_mode": criteria.GameMode},
+	}, criteria.MatchSize)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	found := MatchFound{
+		Name:  match.meta.Name,
+		Guid:  base64.StdEncoding.EncodeToString(match.meta.Guid[:]),
+		Host:  host.Description().UUID,
+		Teams: make([][]string, criteria.Teams),
+	}
+	for _, ticket := range group {
+		for _, member := range ticket.members {
+			found.Teams[ticket.team] = append(found.Teams[ticket.team], member.Description().UUID)
+			match.SetTeam(member, ticket.team)
+		}
+	}
+
+	notifyFound := func(ticket *Ticket) {
+		found.Team = ticket.team
+		ticket.Notify(NewNotification(found, RES_ID_CONFIRMATION, CONF_MATCH_FOUND))
+	}
+
+	// Everyone else joins in queue order, the same as if they had sent join_match
+	notifyFound(group[0])
+	joining := make([][]*Client, 0, len(group))
+	joining = append(joining, group[0].members[1:])
+	for _, ticket := range group[1:] {
+		notifyFound(ticket)
+		joining = append(joining, ticket.members)
+	}
+	for _, members := range joining {
+		if _, err := h.AddToMatch(match, members...); err != nil {
+			log.Println(err)
+		}
+		for _, member := range members {
+			if err := h.AnnouncePeer(member, match); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// A ticket put back after its match fell through goes ahead of tickets queued after it
+func TestRequeuedTicketKeepsItsPlace(t *testing.T) {
+	m := NewMatchmaker(nil)
+	now := time.Now()
+	early := &Ticket{client: &Client{username: "early"}, queued: now.Add(-time.Minute)}
+	first := &Ticket{client: &Client{username: "first"}, queued: now.Add(-30 * time.Second)}
+	late := &Ticket{client: &Client{username: "late"}, queued: now}
+	m.insert(first)
+	m.insert(late)
+
+	m.insert(early)
+	if len(m.tickets) != 3 || m.tickets[0] != early || m.tickets[1] != first || m.tickets[2] != late {
+		t.Errorf("queue is %v, %v, %v", m.tickets[0].client.username, m.tickets[1].client.username, m.tickets[2].client.username)
+	}
+	if early.window(now) == *ratingWindow {
+		t.Error("the requeued ticket's rating window started over")
+	}
+}
+
+// expectConfirmation reads up to the next confirmation, which must be of the kind
+func expectConfirmation(tb testing.TB, client *testClient, kind byte) []byte {
+	tb.Helper()
+	confirmation := client.Expect(RES_ID_CONFIRMATION)
+	if confirmation[1] != kind {
+		tb.Fatalf("got confirmation %q, want kind %d", confirmation, kind)
+	}
+	return confirmation
+}
+
+func TestQueueFormsMatch(t *testing.T) {
+	setFlag(t, matchmakingInterval, 10*time.Millisecond)
+	hub := startHub()
+	first := connect(t, hub, "username=first")
+	second := connect(t, hub, "username=second")
+	for _, client := range []*testClient{first, second} {
+		client.Command(map[string]any{"action": QUEUE_MATCH, "game_mode": "duel", "region": "eu", "match_size": 2, "teams": 2})
+		expectConfirmation(t, client, CONF_QUEUED)
+	}
+
+	var found [2]MatchFound
+	for i, client := range []*testClient{first, second} {
+		if err := json.Unmarshal(expectConfirmation(t, client, CONF_MATCH_FOUND)[2:], &found[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if found[0].Guid != found[1].Guid || found[0].Host != first.id || found[0].Team == found[1].Team || len(found[0].Teams) != 2 {
+		t.Errorf("found %+v and %+v", found[0], found[1])
+	}
+	first.Expect(RES_ID_PEER_CONNECTED)
+}
+
+func TestCancelledTicketIsNotMatched(t *testing.T) {
+	setFlag(t, matchmakingInterval, 10*time.Millisecond)
+	setFlag(t, queueTimeout, 200*time.Millisecond)
+	hub := startHub()
+	cancelled := connect(t, hub, "username=cancelled")
+	waiting := connect(t, hub, "username=waiting")
+	queue := map[string]any{"action": QUEUE_MATCH, "game_mode": "duel", "match_size": 2, "teams": 2}
+
+	cancelled.Command(queue)
+	expectConfirmation(t, cancelled, CONF_QUEUED)
+	cancelled.Command(map[string]any{"action": CANCEL_QUEUE})
+	expectConfirmation(t, cancelled, CONF_QUEUE_CANCELLED)
+
+	// With nobody to match against, the ticket waits out the server's queue timeout
+	waiting.Command(queue)
+	expectConfirmation(t, waiting, CONF_QUEUED)
+	expectConfirmation(t, waiting, CONF_QUEUE_TIMEOUT)
+}
+
+func TestQueueTimeoutIsCapped(t *testing.T) {
+	setFlag(t, matchmakingInterval, 10*time.Millisecond)
+	setFlag(t, queueTimeout, 100*time.Millisecond)
+	hub := startHub()
+	client := connect(t, hub, "username=patient")
+
+	// A client asking to wait longer than the server allows is told the server's timeout
+	client.Command(map[string]any{"action": QUEUE_MATCH, "game_mode": "duel", "match_size": 2, "teams": 2, "timeout": 3600})
+	var status QueueStatus
+	if err := json.Unmarshal(expectConfirmation(t, client, CONF_QUEUED)[2:], &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Timeout > 1 {
+		t.Errorf("queued for %v seconds", status.Timeout)
+	}
+	start := time.Now()
+	expectConfirmation(t, client, CONF_QUEUE_TIMEOUT)
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("timed out after %v", waited)
+	}
+}
@@ -0,0 +1,522 @@
+/** Moderation covers server wide bans and player reports
+
+Bans apply to an identity, an IP address or both, and can expire.
+They are checked when a client connects, and placing one disconnects the clients it applies to.
+Clients don't authenticate, so a client's identity is the username it chose when connecting and nothing verifies it.
+An identity ban is evaded by connecting under another name, and it turns away anyone else who picks the banned name, so bans should rely on the IP.
+Reports likewise name players by identity and also record their IPs.
+
+Reports record who reported whom and why, along with the recent chat of the reported player's match.
+Admins list, add and lift bans and read reports through the admin API, which is served under /admin/ when an admin token is set.
+The token is read from -admin-token-file or the ADMIN_TOKEN environment variable, never from the command line, which /admin/vars publishes.
+
+Bans and reports are kept in a store chosen with -moderation-store: memory, file or redis.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ADMIN_TOKEN_ENV holds the admin token when -admin-token-file isn't set
+const ADMIN_TOKEN_ENV = "ADMIN_TOKEN"
+
+const (
+	MODERATION_STORE_MEMORY = "memory"
+	MODERATION_STORE_FILE   = "file"
+	MODERATION_STORE_REDIS  = "redis"
+)
+
+// Each client can file a few reports at once, and one a minute after that
+const (
+	reportRate  = 1.0 / 60
+	reportBurst = 3
+)
+
+type Ban struct {
+	Identity string `json:"identity,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// Who placed the ban
+	By string `json:"by,omitempty"`
+	// Unix seconds, bans with no expiry last until lifted
+	Created int64 `json:"created"`
+	Expires int64 `json:"expires,omitempty"`
+}
+
+func (b Ban) Active(now time.Time) bool {
+	return b.Expires == 0 || now.Unix() < b.Expires
+}
+
+// Applies reports whether the ban covers a client with the identity or IP
+func (b Ban) Applies(identity string, ip string) bool {
+	return (b.Identity != "" && b.Identity == identity) || (b.IP != "" && b.IP == ip)
+}
+
+// key identifies the ban in a store, a second ban on the same identity and IP replaces the first
+func (b Ban) key() string {
+	return b.Identity + "|" + b.IP
+}
+
+type Report struct {
+	Reporter   string `json:"reporter"`
+	ReporterIP string `json:"reporter_ip,omitempty"`
+	Reported   string `json:"reported"`
+	ReportedIP string `json:"reported_ip,omitempty"`
+	Reason     string `json:"reason"`
+	// Name of the reported player's match
+	Match string `json:"match,omitempty"`
+	// Recent chat of the reported player's match, oldest first
+	Context []json.RawMessage `json:"context,omitempty"`
+	// Unix seconds
+	Created int64 `json:"created"`
+}
+
+type ReportPlayer struct {
+	UUID   string `json:"uuid"`
+	Reason string `json:"reason"`
+}
+
+// ModerationStore keeps bans and reports, it is used from the hub and from HTTP handlers so it must be safe for concurrent use
+type ModerationStore interface {
+	AddBan(ban Ban) error
+	// LiftBans removes every ban on the identity or the IP, returning how many were lifted
+	LiftBans(identity string, ip string) (int, error)
+	// Bans returns the bans that haven't expired
+	Bans() ([]Ban, error)
+	// FindBan returns an active ban applying to the identity or IP, nil if there is none
+	FindBan(identity string, ip string) (*Ban, error)
+	AddReport(report Report) error
+	Reports() ([]Report, error)
+}
+
+func NewModerationStore(kind string) (ModerationStore, error) {
+	switch kind {
+	case MODERATION_STORE_MEMORY:
+		return NewMemoryStore(), nil
+	case MODERATION_STORE_FILE:
+		return NewFileStore(*moderationFile, *reportsFile)
+	case MODERATION_STORE_REDIS:
+		options, err := LoadRedisOptions(*redisConfig)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisStore(options)
+	default:
+		return nil, fmt.Errorf("unknown moderation store %q", kind)
+	}
+}
+
+// MemoryStore loses everything when the server stops
+type MemoryStore struct {
+	mu      sync.Mutex
+	bans    map[string]Ban
+	reports []Report
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{bans: make(map[string]Ban)}
+}
+
+func (s *MemoryStore) AddBan(ban Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bans[ban.key()] = ban
+	return nil
+}
+
+func (s *MemoryStore) LiftBans(identity string, ip string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lifted := 0
+	for key, ban := range s.bans {
+		if ban.Applies(identity, ip) {
+			delete(s.bans, key)
+			lifted++
+		}
+	}
+	return lifted, nil
+}
+
+func (s *MemoryStore) Bans() ([]Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(s.bans))
+	for key, ban := range s.bans {
+		if !ban.Active(now) {
+			delete(s.bans, key)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return int(a.Created - b.Created) })
+	return bans, nil
+}
+
+func (s *MemoryStore) FindBan(identity string, ip string) (*Ban, error) {
+	bans, err := s.Bans()
+	if err != nil {
+		return nil, err
+	}
+	for _, ban := range bans {
+		if ban.Applies(identity, ip) {
+			return &ban, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) AddReport(report Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func (s *MemoryStore) Reports() ([]Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.reports), nil
+}
+
+// FileStore keeps its bans in memory and saves them to a JSON file after every change
+// Reports are only appended to a JSON lines file, so filing one costs a single write however many there are
+type FileStore struct {
+	*MemoryStore
+	path string
+	// Serializes saves so an older snapshot never replaces a newer one
+	saving sync.Mutex
+
+	reportsPath string
+	reportsMu   sync.Mutex
+	reports     *os.File
+}
+
+type fileStoreContents struct {
+	Bans []Ban `json:"bans"`
+}
+
+func NewFileStore(path string, reportsPath string) (*FileStore, error) {
+	if path == "" || reportsPath == "" {
+		return nil, errors.New("the file moderation store needs -moderation-file and -reports-file")
+	}
+	reports, err := os.OpenFile(reportsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{MemoryStore: NewMemoryStore(), path: path, reportsPath: reportsPath, reports: reports}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		reports.Close()
+		return nil, err
+	}
+	var contents fileStoreContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		reports.Close()
+		return nil, fmt.Errorf("could not read %v: %w", path, err)
+	}
+	for _, ban := range contents.Bans {
+		s.bans[ban.key()] = ban
+	}
+	return s, nil
+}
+
+// save replaces the file through a rename so a crash mid write leaves the old contents
+func (s *FileStore) save() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	bans, _ := s.MemoryStore.Bans()
+	data, err := json.MarshalIndent(fileStoreContents{Bans: bans}, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
+
+func (s *FileStore) AddBan(ban Ban) error {
+	s.MemoryStore.AddBan(ban)
+	return s.save()
+}
+
+func (s *FileStore) LiftBans(identity string, ip string) (int, error) {
+	lifted, _ := s.MemoryStore.LiftBans(identity, ip)
+	if lifted == 0 {
+		return 0, nil
+	}
+	return lifted, s.save()
+}
+
+func (s *FileStore) AddReport(report Report) error {
+	line, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	s.reportsMu.Lock()
+	defer s.reportsMu.Unlock()
+
+	_, err = s.reports.Write(append(line, '\n'))
+	return err
+}
+
+// Reports reads the reports back from their file, stopping at a line cut short by a crash
+func (s *FileStore) Reports() ([]Report, error) {
+	file, err := os.Open(s.reportsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reports := make([]Report, 0)
+	decoder := json.NewDecoder(file)
+	for {
+		var report Report
+		err := decoder.Decode(&report)
+		if err == io.EOF {
+			return reports, nil
+		}
+		if err != nil {
+			log.Println("Could not read a report: ", err)
+			return reports, nil
+		}
+		reports = append(reports, report)
+	}
+}
+
+// Identity is who the client claims to be, the username it connected with
+// It is not verified, so it labels bans and reports but can't be trusted to keep anyone out
+func (c *Client) Identity() string {
+	return c.username
+}
+
+// RemoteIP is the address a request came from, taken from X-Forwarded-For when the server trusts its proxy
+func RemoteIP(r *http.Request) string {
+	if *trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// CheckBan returns why a client with the identity and IP may not connect, empty if it may
+// The server stays open if the store can't be reached, since turning everyone away would be worse than letting a banned player through
+func (h *Hub) CheckBan(identity string, ip string) string {
+	ban, err := h.moderation.FindBan(identity, ip)
+	if err != nil {
+		log.Println("Could not check bans: ", err)
+		return ""
+	}
+	if ban == nil {
+		return ""
+	}
+	msg := "Banned from this server"
+	if ban.Reason != "" {
+		msg += ": " + ban.Reason
+	}
+	if ban.Expires != 0 {
+		msg += fmt.Sprintf(" (until %v)", time.Unix(ban.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	return msg
+}
+
+// EnforceBan disconnects every connected client the ban applies to
+func (h *Hub) EnforceBan(ban Ban) {
+	for _, client := range h.clients {
+		if ban.Applies(client.Identity(), client.ip) {
+			log.Printf("AUDIT disconnecting %v (%v), banned from the server", client.username, client.ip)
+			client.SendError(ERR_BANNED, ban.Reason)
+			h.Disconnect(client)
+		}
+	}
+}
+
+func (h *Hub) HandleReportPlayer(client *Client, message ReportPlayer) error {
+	log.Println("Report player requested...")
+
+	uid, err := DecodeUUID(message.UUID)
+	if err != nil {
+		return err
+	}
+	reported := h.clients[uid.String()]
+	var msg string
+	if reported == nil {
+		msg = "Player is not connected"
+	} else if reported == client {
+		msg = "Can't report yourself"
+	} else if !client.reportLimiter.Allow() {
+		msg = "Sending reports too quickly"
+	}
+	if msg != "" {
+		log.Println(msg)
+		client.SendError(ERR_BAD_COMMAND, msg)
+		return nil
+	}
+
+	report := Report{
+		Reporter:   client.Identity(),
+		ReporterIP: client.ip,
+		Reported:   reported.Identity(),
+		ReportedIP: reported.ip,
+		Reason:     message.Reason,
+		Created:    time.Now().Unix(),
+	}
+	if match := h.matchByClient[reported]; match != nil {
+		report.Match = match.meta.Name
+		for _, chat := range match.chatHistory.messages {
+			if message, err := chat.Encode(JSONCodec); err == nil {
+				// Strip the RES_ID, leaving the chat message JSON
+				report.Context = append(report.Context, message[1:])
+			}
+		}
+	}
+	if err := h.moderation.AddReport(report); err != nil {
+		log.Println("Could not store the report: ", err)
+		client.SendError(ERR_BAD_COMMAND, "Report could not be recorded")
+		return nil
+	}
+	log.Printf("AUDIT %v reported %v: %q", report.Reporter, report.Reported, report.Reason)
+	return nil
+}
+
+// LoadAdminToken reads the admin token from the file, or from ADMIN_TOKEN_ENV without one, empty means the admin API is disabled
+func LoadAdminToken(path string) (string, error) {
+	if path == "" {
+		return strings.TrimSpace(os.Getenv(ADMIN_TOKEN_ENV)), nil
+	}
+	token, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// AddBan is the body of a ban added through the admin API
+type AddBan struct {
+	Identity string `json:"identity"`
+	IP       string `json:"ip"`
+	Reason   string `json:"reason"`
+	// Seconds until the ban expires, zero for a ban that lasts until lifted
+	Duration int64 `json:"duration"`
+}
+
+// ServeAdmin handles the admin API, every request must carry the admin token as a bearer token
+//
+//	GET    /admin/bans                      active bans
+//	POST   /admin/bans                      add a ban, see AddBan
+//	DELETE /admin/bans?identity=...&ip=...  lift the bans on an identity or IP
+//	GET    /admin/reports                   every report
+//	GET    /admin/clients                   connected clients and their latency
+//	GET    /admin/vars                      expvar metrics
+func (h *Hub) ServeAdmin(w http.ResponseWriter, r *http.Request) {
+	// Compared in constant time so response times don't give the token away
+	if h.adminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.adminToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/admin/vars" && r.Method == http.MethodGet {
+		expvar.Handler().ServeHTTP(w, r)
+		return
+	}
+
+	var response any
+	var err error
+	switch {
+	case r.URL.Path == "/admin/bans" && r.Method == http.MethodGet:
+		response, err = h.moderation.Bans()
+	case r.URL.Path == "/admin/bans" && r.Method == http.MethodPost:
+		var add AddBan
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(*maxCommandSize))).Decode(&add); err != nil {
+			http.Error(w, "malformed ban", http.StatusBadRequest)
+			return
+		}
+		if add.Identity == "" && add.IP == "" {
+			http.Error(w, "a ban needs an identity or an IP", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		ban := Ban{
+			Identity: add.Identity,
+			IP:       add.IP,
+			Reason:   add.Reason,
+			By:       "admin",
+			Created:  now.Unix(),
+		}
+		if add.Duration > 0 {
+			ban.Expires = now.Add(time.Duration(add.Duration) * time.Second).Unix()
+		}
+		if err = h.moderation.AddBan(ban); err == nil {
+			log.Printf("AUDIT admin banned identity %q, IP %q: %q", ban.Identity, ban.IP, ban.Reason)
+			h.bans <- ban
+			response = ban
+		}
+	case r.URL.Path == "/admin/bans" && r.Method == http.MethodDelete:
+		identity, ip := r.URL.Query().Get("identity"), r.URL.Query().Get("ip")
+		if identity == "" && ip == "" {
+			http.Error(w, "lifting bans needs an identity or an IP", http.StatusBadRequest)
+			return
+		}
+		var lifted int
+		if lifted, err = h.moderation.LiftBans(identity, ip); err == nil {
+			log.Printf("AUDIT admin lifted %d bans on identity %q, IP %q", lifted, identity, ip)
+			response = map[string]int{"lifted": lifted}
+		}
+	case r.URL.Path == "/admin/reports" && r.Method == http.MethodGet:
+		response, err = h.moderation.Reports()
+	case r.URL.Path == "/admin/clients" && r.Method == http.MethodGet:
+		response = h.ClientStats()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		log.Println("Admin request failed: ", err)
+		http.Error(w, "moderation store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModerationStores(t *testing.T) {
+	dir := t.TempDir()
+	path, reportsPath := filepath.Join(dir, "moderation.json"), filepath.Join(dir, "reports.jsonl")
+	openFile := func() ModerationStore {
+		store, err := NewFileStore(path, reportsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+
+	stores := []struct {
+		name string
+		open func() ModerationStore
+		// Whether a store opened again sees what the first one stored
+		persistent bool
+	}{
+		{"memory", func() ModerationStore { return NewMemoryStore() }, false},
+		{"file", openFile, true},
+	}
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			store := test.open()
+			if err := store.AddBan(Ban{Identity: "griefer", Reason: "griefing"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddBan(Ban{IP: "10.0.0.1", Expires: 1}); err != nil {
+				t.Fatal(err)
+			}
+			for _, report := range []Report{{Reporter: "a", Reported: "griefer"}, {Reporter: "b", Reported: "griefer"}} {
+				if err := store.AddReport(report); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.persistent {
+				store = test.open()
+			}
+			if ban, _ := store.FindBan("griefer", ""); ban == nil || ban.Reason != "griefing" {
+				t.Errorf("got ban %+v for the banned identity", ban)
+			}
+			if ban, _ := store.FindBan("", "10.0.0.1"); ban != nil {
+				t.Errorf("expired ban %+v still applies", ban)
+			}
+			if reports, _ := store.Reports(); len(reports) != 2 || reports[1].Reporter != "b" {
+				t.Errorf("got reports %+v", reports)
+			}
+
+			if lifted, _ := store.LiftBans("griefer", ""); lifted != 1 {
+				t.Errorf("lifted %d bans, want 1", lifted)
+			}
+			if ban, _ := store.FindBan("griefer", ""); ban != nil {
+				t.Errorf("lifted ban %+v still applies", ban)
+			}
+		})
+	}
+}
+
+func TestLoadRedisOptions(t *testing.T) {
+	options, err := LoadRedisOptions("../debug.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Addr != "127.0.0.1:1234" || options.Username != "admin" || options.Password != "password" {
+		t.Errorf("got addr %q, username %q, password %q", options.Addr, options.Username, options.Password)
+	}
+
+	path := filepath.Join(t.TempDir(), "other.ini")
+	if err := os.WriteFile(path, []byte("[other]\nhost=127.0.0.1\nport=1234\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRedisOptions(path); err == nil {
+		t.Error("loaded a file without a [redis] section")
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ADMIN_TOKEN_ENV, "from-env")
+	if token, err := LoadAdminToken(path); err != nil || token != "from-file" {
+		t.Errorf("got %q, %v from the file", token, err)
+	}
+	if token, err := LoadAdminToken(""); err != nil || token != "from-env" {
+		t.Errorf("got %q, %v from the environment", token, err)
+	}
+
+	hub := NewHub()
+	hub.adminToken = "secret"
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		status        int
+	}{
+		{"vars without the token", "/admin/vars", "", http.StatusUnauthorized},
+		{"vars with a wrong token", "/admin/vars", "Bearer guess", http.StatusUnauthorized},
+		{"vars with the token", "/admin/vars", "Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			response := httptest.NewRecorder()
+			hub.ServeAdmin(response, request)
+			if response.Code != test.status {
+				t.Errorf("got status %v, want %v", response.Code, test.status)
+			}
+			if test.status == http.StatusOK && !strings.Contains(response.Body.String(), "compression_bytes_saved") {
+				t.Errorf("metrics missing from %s", response.Body)
+			}
+		})
+	}
+}
+
+// The banned client is told why before its connection closes, even when its writes are behind
+func TestBanReasonReachesClient(t *testing.T) {
+	hub := startHub()
+	for i := 0; i < 20; i++ {
+		client := connect(t, hub, fmt.Sprintf("username=griefer%d", i))
+		resume := client.transport.Pause()
+		client.Command(map[string]any{"action": LIST_MATCHES})
+		time.Sleep(10 * time.Millisecond)
+		hub.bans <- Ban{Identity: fmt.Sprintf("griefer%d", i), Reason: "griefing"}
+		time.Sleep(10 * time.Millisecond)
+		resume()
+		if banned := client.Expect(RES_ID_ERROR); banned[1] != ERR_BANNED || string(banned[2:]) != "griefing" {
+			t.Fatalf("got %q", banned)
+		}
+	}
+}
@@ -4,3 +4,52 @@ For instance, messages saying a player has connected or disconnected are sent as
 */
 
 package main
+
+import (
+	"log"
+)
+
+// SendError notifies the client that something it sent was rejected
+func (c *Client) SendError(code byte, msg string) {
+	response := []byte{RES_ID_ERROR, code}
+	response = append(response, []byte(msg)...)
+	c.Send(response)
+}
+
+// Notification is a server message with a body, which is encoded in each recipient's codec
+// Each encoding is kept, so a notification sent to many clients is encoded at most once per codec
+// A notification belongs to one goroutine at a time
+type Notification struct {
+	header  []byte
+	body    any
+	encoded map[Codec][]byte
+}
+
+// NewNotification makes a notification of the body after the header, the header being the RES_ID and any code
+func NewNotification(body any, header ...byte) *Notification {
+	return &Notification{header: header, body: body, encoded: make(map[Codec][]byte)}
+}
+
+// Encode returns the whole message with the body in the codec
+func (n *Notification) Encode(codec Codec) ([]byte, error) {
+	if message, ok := n.encoded[codec]; ok {
+		return message, nil
+	}
+	body, err := codec.Marshal(n.body)
+	if err != nil {
+		return nil, err
+	}
+	message := append(n.header[:len(n.header):len(n.header)], body...)
+	n.encoded[codec] = message
+	return message, nil
+}
+
+// Notify sends the notification to the client in the client's codec
+func (c *Client) Notify(notification *Notification) {
+	message, err := notification.Encode(c.codec)
+	if err != nil {
+		log.Println("Could not encode the notification: ", err)
+		return
+	}
+	c.Send(message)
+}
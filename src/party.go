@@ -0,0 +1,191 @@
+/** Parties are groups of players that move between matches together
+
+The leader invites players, who join by accepting the invite.
+When the leader hosts, joins or queues for a match the whole party comes along, and a join is refused if the match lacks room for everyone.
+Members other than the leader can't join or queue on their own while they are in a party.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"slices"
+)
+
+type Party struct {
+	guid uuid.UUID
+	// The leader is always the first member
+	members []*Client
+	invited map[*Client]bool
+}
+
+func (p *Party) Leader() *Client {
+	return p.members[0]
+}
+
+type PartyDescription struct {
+	Guid    string              `json:"guid"`
+	Leader  string              `json:"leader"`
+	Members []ClientDescription `json:"members"`
+}
+
+func (p *Party) Description() PartyDescription {
+	description := PartyDescription{
+		Guid:    base64.StdEncoding.EncodeToString(p.guid[:]),
+		Members: make([]ClientDescription, 0, len(p.members)),
+	}
+	if len(p.members) > 0 {
+		description.Leader = p.Leader().Description().UUID
+	}
+	for _, member := range p.members {
+		description.Members = append(description.Members, member.Description())
+	}
+	return description
+}
+
+type PartyInvite struct {
+	Party string            `json:"party"`
+	From  ClientDescription `json:"from"`
+}
+
+type InviteToParty struct {
+	UUID string `json:"uuid"`
+}
+
+type AcceptPartyInvite struct {
+	UUID string `json:"uuid"`
+}
+
+// PartyMembers returns the clients that move with the client, the whole party when it leads one and just the client when it's in none
+// Members other than the leader get an error since they can't move on their own
+func (h *Hub) PartyMembers(client *Client) ([]*Client, error) {
+	party := h.partyByClient[client]
+	if party == nil {
+		return []*Client{client}, nil
+	}
+	if party.Leader() != client {
+		return nil, errors.New("only the party leader can do that")
+	}
+	return slices.Clone(party.members), nil
+}
+
+func (h *Hub) HandleCreateParty(client *Client) error {
+	log.Println("Create party requested...")
+
+	if h.partyByClient[client] != nil {
+		client.SendError(ERR_BAD_COMMAND, "Already in a party")
+		return nil
+	}
+
+	guid, err := uuid.NewUUID()
+	if err != nil {
+		log.Println("Could not create UUID for new party")
+		return err
+	}
+
+	party := &Party{
+		guid:    guid,
+		members: []*Client{client},
+		invited: make(map[*Client]bool),
+	}
+	h.parties[guid.String()] = party
+	h.partyByClient[client] = party
+
+	return h.SendPartyUpdate(party)
+}
+
+func (h *Hub) HandleInviteToParty(client *Client, message InviteToParty) error {
+	log.Println("Party invite requested...")
+
+	uid, err := DecodeUUID(message.UUID)
+	if err != nil {
+		return err
+	}
+
+	party := h.partyByClient[client]
+	invitee := h.clients[uid.String()]
+	var msg string
+	if party == nil || party.Leader() != client {
+		msg = "Only the party leader can invite players"
+	} else if invitee == nil {
+		msg = "Player does not exist"
+	} else if slices.Contains(party.members, invitee) {
+		msg = "Player is already in the party"
+	} else if len(party.members)+len(party.invited) >= *maxMatchSize {
+		msg = fmt.Sprintf("Parties are limited to %d players", *maxMatchSize)
+	}
+	if msg != "" {
+		log.Println(msg)
+		client.SendError(ERR_BAD_COMMAND, msg)
+		return nil
+	}
+
+	party.invited[invitee] = true
+	invitee.Notify(NewNotification(PartyInvite{
+		Party: base64.StdEncoding.EncodeToString(party.guid[:]),
+		From:  client.Description(),
+	}, RES_ID_PARTY_INVITE))
+	return nil
+}
+
+func (h *Hub) HandleAcceptPartyInvite(client *Client, message AcceptPartyInvite) error {
+	log.Println("Accept party invite requested...")
+
+	uid, err := DecodeUUID(message.UUID)
+	if err != nil {
+		return err
+	}
+
+	party := h.parties[uid.String()]
+	if party == nil || !party.invited[client] {
+		msg := "No invite to that party"
+		log.Println(msg)
+		client.SendError(ERR_BAD_COMMAND, msg)
+		return nil
+	}
+
+	h.LeaveParty(client)
+	delete(party.invited, client)
+	party.members = append(party.members, client)
+	h.partyByClient[client] = party
+	// The party's plans changed, so the leader has to queue again
+	h.matchmaker.Cancel(party.Leader())
+
+	return h.SendPartyUpdate(party)
+}
+
+// LeaveParty takes the client out of its party, handing leadership to the next member and disbanding the party once it's empty
+func (h *Hub) LeaveParty(client *Client) {
+	party := h.partyByClient[client]
+	if party == nil {
+		return
+	}
+
+	h.matchmaker.Cancel(party.Leader())
+	delete(h.partyByClient, client)
+	party.members = slices.DeleteFunc(party.members, func(member *Client) bool { return member == client })
+
+	// Let the client know it is no longer in the party
+	client.Notify(NewNotification(PartyDescription{Members: make([]ClientDescription, 0)}, RES_ID_PARTY_UPDATE))
+
+	if len(party.members) == 0 {
+		delete(h.parties, party.guid.String())
+		return
+	}
+	if err := h.SendPartyUpdate(party); err != nil {
+		log.Println(err)
+	}
+}
+
+// SendPartyUpdate tells every member of the party who is in it
+func (h *Hub) SendPartyUpdate(party *Party) error {
+	notify := NewNotification(party.Description(), RES_ID_PARTY_UPDATE)
+	for _, member := range party.members {
+		member.Notify(notify)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// formParty has the leader create a party and the members accept its invites
+func formParty(tb testing.TB, leader *testClient, members ...*testClient) {
+	tb.Helper()
+	leader.Command(map[string]any{"action": CREATE_PARTY})
+	var party PartyDescription
+	if err := json.Unmarshal(leader.Expect(RES_ID_PARTY_UPDATE)[1:], &party); err != nil {
+		tb.Fatal(err)
+	}
+	for _, member := range members {
+		leader.Command(map[string]any{"action": INVITE_TO_PARTY, "uuid": member.id})
+		member.Expect(RES_ID_PARTY_INVITE)
+		member.Command(map[string]any{"action": ACCEPT_PARTY_INVITE, "uuid": party.Guid})
+		member.Expect(RES_ID_PARTY_UPDATE)
+		leader.Expect(RES_ID_PARTY_UPDATE)
+	}
+}
+
+func TestPartyJoinsTogether(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	leader := connect(t, hub, "username=leader")
+	first := connect(t, hub, "username=first")
+	second := connect(t, hub, "username=second")
+	formParty(t, leader, first, second)
+	match := hostAndJoin(t, host)
+
+	// Members follow their leader, they can't go on their own
+	first.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	if refused := first.Expect(CONF_FAILED_JOIN); string(refused[1:]) != "Only the party leader can join a match" {
+		t.Errorf("member got %q joining alone", refused)
+	}
+
+	leader.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	joined := make(map[string]bool)
+	for range 3 {
+		var peer ClientDescription
+		if err := json.Unmarshal(host.Expect(RES_ID_PEER_CONNECTED)[1:], &peer); err != nil {
+			t.Fatal(err)
+		}
+		joined[peer.UUID] = true
+	}
+	for _, member := range []*testClient{leader, first, second} {
+		if !joined[member.id] {
+			t.Errorf("%v didn't join", member.id)
+		}
+		member.Expect(CONF_JOIN_MATCH)
+	}
+}
+
+func TestPartyNeedsRoomForEveryone(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	players := []*testClient{connect(t, hub, "username=p1"), connect(t, hub, "username=p2")}
+	match := hostAndJoin(t, host, players...)
+	leader := connect(t, hub, "username=leader")
+	member := connect(t, hub, "username=member")
+	formParty(t, leader, member)
+
+	// One seat left for a party of two
+	leader.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	if refused := leader.Expect(CONF_FAILED_JOIN); string(refused[1:]) != "Not enough room for the whole party" {
+		t.Fatalf("got %q", refused)
+	}
+
+	// Nobody went in, so a single player still fits
+	single := connect(t, hub, "username=single")
+	single.Command(map[string]any{"action": JOIN_MATCH, "uuid": match})
+	var peer ClientDescription
+	if err := json.Unmarshal(host.Expect(RES_ID_PEER_CONNECTED)[1:], &peer); err != nil {
+		t.Fatal(err)
+	}
+	if peer.UUID != single.id {
+		t.Errorf("%v joined instead of the single player", peer.Username)
+	}
+}
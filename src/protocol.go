@@ -0,0 +1,94 @@
+/** Protocol versions let the wire format change without breaking players on older builds
+
+Clients declare what they speak with query parameters, on the websocket URL or in the TCP hello:
+- version: the protocol version the client was built for, clients that don't send one are taken to speak version 1
+- capabilities: comma separated optional features the client can handle, like capabilities=batching,cbor,fragmentation
+
+A client newer than the server is downgraded to the server's version, it must then speak that version.
+A client older than -min-protocol-version is turned away: websocket clients get a close frame with CLOSE_UNSUPPORTED_VERSION and the reason, TCP clients a close frame with the reason.
+
+Capabilities the server doesn't know or can't offer are left out, the ones granted are set in the features byte of the connected confirmation.
+Compact headers are one the server knows and never grants, see CAPABILITY_COMPACT_HEADERS.
+
+Versions:
+1: the original protocol, the connected confirmation ends at the GUID and there is no resuming or UDP
+2: the connected confirmation carries the features byte, the negotiated protocol version (1 byte), then the resume and UDP tokens; capabilities
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	PROTOCOL_VERSION     = 2
+	MIN_PROTOCOL_VERSION = 1
+)
+
+// Capabilities a client can ask for
+const (
+	// Ticking matches send RES_ID_BATCH frames, clients without it get each relay packet as it comes
+	CAPABILITY_BATCHING = "batching"
+	// Commands and responses are CBOR instead of JSON, see encoding.go
+	CAPABILITY_CBOR = "cbor"
+	// Large messages are sent as RES_ID_FRAGMENT frames, only granted when the server runs with -fragmentation
+	CAPABILITY_FRAGMENTATION = "fragmentation"
+	// Short peer IDs in place of the 24 byte base64 GUID in relay headers, which is never granted
+	// Relay, reliable and latest-only packets, UDP datagrams and recordings all address peers by GUID, so compact headers would
+	// need a second addressing scheme through all of them, and permessage-deflate already takes most of the cost out of repeated GUIDs
+	CAPABILITY_COMPACT_HEADERS = "compact_headers"
+)
+
+// Websocket close codes, from the range kept for applications
+const (
+	CLOSE_MALFORMED_HANDSHAKE = 4000
+	CLOSE_UNSUPPORTED_VERSION = 4001
+)
+
+// Negotiation is what a client and the server agreed to speak
+type Negotiation struct {
+	Version       int
+	Batching      bool
+	CBOR          bool
+	Fragmentation bool
+}
+
+// Negotiate settles the protocol version and capabilities from a connecting client's query parameters
+func Negotiate(query url.Values) (Negotiation, *Refusal) {
+	negotiation := Negotiation{Version: 1}
+	if version := query.Get("version"); version != "" {
+		parsed, err := strconv.Atoi(version)
+		if err != nil || parsed < 1 {
+			return negotiation, &Refusal{CloseCode: CLOSE_MALFORMED_HANDSHAKE, Reason: fmt.Sprintf("Malformed protocol version %q", version)}
+		}
+		negotiation.Version = min(parsed, PROTOCOL_VERSION)
+	}
+	if negotiation.Version < *minProtocolVersion {
+		return negotiation, &Refusal{
+			CloseCode: CLOSE_UNSUPPORTED_VERSION,
+			Reason:    fmt.Sprintf("Protocol version %d is no longer supported, update to version %d or later", negotiation.Version, *minProtocolVersion),
+		}
+	}
+
+	// Capabilities came with version 2
+	if negotiation.Version < 2 {
+		return negotiation, nil
+	}
+	for _, capability := range strings.Split(query.Get("capabilities"), ",") {
+		switch strings.TrimSpace(capability) {
+		case CAPABILITY_BATCHING:
+			negotiation.Batching = true
+		case CAPABILITY_CBOR:
+			negotiation.CBOR = true
+		case CAPABILITY_FRAGMENTATION:
+			negotiation.Fragmentation = *fragmentation
+		case CAPABILITY_COMPACT_HEADERS:
+			// Not offered, the client keeps the GUID headers
+		}
+	}
+	return negotiation, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnectedConfirmationByVersion(t *testing.T) {
+	setFlag(t, resumeWindow, time.Minute)
+	hub := startHub()
+
+	// Code, confirmation, base64 GUID, then from version 2 the features byte, version byte and resume token
+	const guidEnd = 2 + 24
+	tests := []struct {
+		name   string
+		query  string
+		length int
+	}{
+		{"version 1", "username=old", guidEnd},
+		{"version 2", "username=new&version=2", guidEnd + 2 + len(NewResumeToken())},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			request, refusal := hub.Admit(values, "127.0.0.1")
+			if refusal != nil {
+				t.Fatal(refusal.Reason)
+			}
+			transport := newPipeTransport()
+			hub.Connect(request, transport, false)
+			connected := (&testClient{tb: t, transport: transport}).Expect(RES_ID_CONFIRMATION)
+			if len(connected) != test.length {
+				t.Errorf("confirmation is %v bytes, want %v: %q", len(connected), test.length, connected)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	setFlag(t, fragmentation, false)
+	tests := []struct {
+		name         string
+		capabilities string
+		want         Negotiation
+	}{
+		{"none", "", Negotiation{Version: 2}},
+		{"batching and cbor", "batching, cbor", Negotiation{Version: 2, Batching: true, CBOR: true}},
+		{"fragmentation while disabled", "fragmentation", Negotiation{Version: 2}},
+		{"compact headers are never granted", "compact_headers,batching", Negotiation{Version: 2, Batching: true}},
+		{"unknown", "telepathy", Negotiation{Version: 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			negotiation, refusal := Negotiate(url.Values{"version": {"2"}, "capabilities": {test.capabilities}})
+			if refusal != nil {
+				t.Fatal(refusal.Reason)
+			}
+			if negotiation != test.want {
+				t.Errorf("negotiated %+v, want %+v", negotiation, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+/** Recordings capture the relayed traffic of a match so it can be replayed later, for example to reproduce a desync
+
+Recording is opted into per match when hosting, and only when the server has a recording directory.
+A recording is an append only file named after the match GUID, made of a header followed by records.
+
+Header: magic | start time, unix microseconds (int64 LE) | match GUID (16 bytes)
+Record: kind (1 byte) | microseconds since start (uvarint) | sender GUID (16 bytes) | target GUID (16 bytes) | payload length (uvarint) | payload
+
+Relay records hold the packet as sent, a nil target being a broadcast.
+Join and leave records hold the client description of the sender, and metadata records the match description, as JSON.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	RECORD_RELAY    = byte(0)
+	RECORD_JOIN     = byte(1)
+	RECORD_LEAVE    = byte(2)
+	RECORD_METADATA = byte(3)
+)
+
+const (
+	recordingMagic         = "EZREC1"
+	recordingExtension     = ".rec"
+	recordingFlushInterval = time.Second
+)
+
+// RecordingPath is where the recording of a match lives
+func RecordingPath(match uuid.UUID) string {
+	return filepath.Join(*recordDir, match.String()+recordingExtension)
+}
+
+// Recorder appends records for a match, it is written by both the hub and the match goroutine so it is guarded by mu
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	started time.Time
+	closed  chan struct{}
+}
+
+func NewRecorder(path string, match uuid.UUID) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		started: time.Now(),
+		closed:  make(chan struct{}),
+	}
+	r.writer.WriteString(recordingMagic)
+	binary.Write(r.writer, binary.LittleEndian, r.started.UnixMicro())
+	r.writer.Write(match[:])
+	if err := r.writer.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	go r.flushPeriodically()
+	return r, nil
+}
+
+// Record appends a record, doing nothing when the recorder is nil so matches that aren't recorded can call it freely
+func (r *Recorder) Record(kind byte, sender uuid.UUID, target uuid.UUID, payload []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.writer == nil {
+		return
+	}
+	r.writer.WriteByte(kind)
+	r.writer.Write(binary.AppendUvarint(nil, uint64(time.Since(r.started).Microseconds())))
+	r.writer.Write(sender[:])
+	r.writer.Write(target[:])
+	r.writer.Write(binary.AppendUvarint(nil, uint64(len(payload))))
+	r.writer.Write(payload)
+}
+
+func (r *Recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.writer == nil {
+		return
+	}
+	if err := r.writer.Flush(); err != nil {
+		log.Println("Could not flush the recording: ", err)
+	}
+}
+
+// flushPeriodically bounds how much of a recording is lost if the server goes down mid match
+func (r *Recorder) flushPeriodically() {
+	ticker := time.NewTicker(recordingFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// Close flushes and closes the recording, later records are dropped
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	r.flush()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.writer == nil {
+		return
+	}
+	r.writer = nil
+	close(r.closed)
+	if err := r.file.Close(); err != nil {
+		log.Println("Could not close the recording: ", err)
+	}
+}
+
+// StartRecording records the match from here on, hosting goes ahead unrecorded if the recording can't be created
+func (h *Hub) StartRecording(match *Match) {
+	recorder, err := NewRecorder(RecordingPath(match.meta.Guid), match.meta.Guid)
+	if err != nil {
+		log.Println("Could not start recording, hosting without it: ", err)
+		match.mu.Lock()
+		match.meta.Recording = false
+		match.mu.Unlock()
+		return
+	}
+	match.recorder = recorder
+	RecordMetadata(match)
+	for _, client := range match.Clients() {
+		RecordPeer(match, RECORD_JOIN, client)
+	}
+}
+
+// RecordMetadata records the current description of the match
+func RecordMetadata(match *Match) {
+	if match.recorder == nil {
+		return
+	}
+	if packet, err := json.Marshal(match.Description()); err != nil {
+		log.Println("Could not marshall the match description")
+	} else {
+		match.recorder.Record(RECORD_METADATA, match.meta.Guid, uuid.Nil, packet)
+	}
+}
+
+// RecordPeer records a client joining or leaving the match
+func RecordPeer(match *Match, kind byte, client *Client) {
+	if match.recorder == nil {
+		return
+	}
+	if packet, err := json.Marshal(client.Description()); err != nil {
+		log.Println("Could not marshall the client description")
+	} else {
+		match.recorder.Record(kind, client.guid, uuid.Nil, packet)
+	}
+}
+
+type Record struct {
+	Kind    byte
+	Elapsed time.Duration
+	Sender  uuid.UUID
+	Target  uuid.UUID
+	Payload []byte
+}
+
+// RecordingReader reads the records of a recording in order
+type RecordingReader struct {
+	file    *os.File
+	reader  *bufio.Reader
+	Started time.Time
+	Match   uuid.UUID
+}
+
+func OpenRecording(path string) (*RecordingReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RecordingReader{file: file, reader: bufio.NewReader(file)}
+	magic := make([]byte, len(recordingMagic))
+	var started int64
+	if _, err := io.ReadFull(r.reader, magic); err != nil || string(magic) != recordingMagic {
+		file.Close()
+		return nil, errors.New("not a recording")
+	}
+	if err := binary.Read(r.reader, binary.LittleEndian, &started); err != nil {
+		file.Close()
+		return nil, errors.New("recording header is truncated")
+	}
+	if _, err := io.ReadFull(r.reader, r.Match[:]); err != nil {
+		file.Close()
+		return nil, errors.New("recording header is truncated")
+	}
+	r.Started = time.UnixMicro(started)
+	return r, nil
+}
+
+// Next returns the next record, io.EOF once the recording is over
+// A record cut short by the server going down also ends the recording
+func (r *RecordingReader) Next() (Record, error) {
+	var record Record
+	kind, err := r.reader.ReadByte()
+	if err != nil {
+		return record, io.EOF
+	}
+	record.Kind = kind
+
+	elapsed, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return record, io.EOF
+	}
+	record.Elapsed = time.Duration(elapsed) * time.Microsecond
+	if _, err := io.ReadFull(r.reader, record.Sender[:]); err != nil {
+		return record, io.EOF
+	}
+	if _, err := io.ReadFull(r.reader, record.Target[:]); err != nil {
+		return record, io.EOF
+	}
+
+	length, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return record, io.EOF
+	}
+	if length > uint64(max(*maxRelaySize, *maxReassembledSize)) {
+		return record, fmt.Errorf("record of %d bytes is larger than any relayed packet", length)
+	}
+	record.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r.reader, record.Payload); err != nil {
+		return record, io.EOF
+	}
+	return record, nil
+}
+
+func (r *RecordingReader) Close() error {
+	return r.file.Close()
+}
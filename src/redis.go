@@ -0,0 +1,172 @@
+/** A moderation store kept in Redis, so several relay servers can share bans
+
+Bans live in a hash from ban key to ban JSON, with expired bans removed as they are found.
+Reports are appended to a list of report JSON.
+
+The server reaches Redis with the host, port, username and password in the [redis] section of the -redis-config ini file.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/wlevene/ini"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	redisBansKey    = "easy_relay:bans"
+	redisReportsKey = "easy_relay:reports"
+	redisTimeout    = 2 * time.Second
+)
+
+type RedisStore struct {
+	client *redis.Client
+}
+
+// LoadRedisOptions reads the [redis] section of an ini file
+func LoadRedisOptions(path string) (*redis.Options, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// The parser never returns from a value at the very end of the file, so the file gets a newline after it
+	config := ini.New().Load(append(data, '\n'))
+	if err := config.Err(); err != nil {
+		return nil, fmt.Errorf("could not parse %v: %w", path, err)
+	}
+	section := config.Section("redis")
+	// Quotes are kept in the values
+	get := func(key string) string {
+		return strings.Trim(section.Get(key), `"`)
+	}
+	host, port := get("host"), get("port")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("%v has no [redis] host and port", path)
+	}
+
+	return &redis.Options{
+		Addr:         net.JoinHostPort(host, port),
+		Username:     get("username"),
+		Password:     get("password"),
+		DialTimeout:  redisTimeout,
+		ReadTimeout:  redisTimeout,
+		WriteTimeout: redisTimeout,
+	}, nil
+}
+
+// NewRedisStore connects to Redis up front so a bad address is found at startup
+func NewRedisStore(options *redis.Options) (*RedisStore, error) {
+	s := &RedisStore{client: redis.NewClient(options)}
+	if err := s.client.Ping(context.Background()).Err(); err != nil {
+		s.client.Close()
+		return nil, fmt.Errorf("could not reach redis at %v: %w", options.Addr, err)
+	}
+	return s, nil
+}
+
+func (s *RedisStore) AddBan(ban Ban) error {
+	packet, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(context.Background(), redisBansKey, ban.key(), packet).Err()
+}
+
+// allBans returns every stored ban by key, expired ones included
+func (s *RedisStore) allBans() (map[string]Ban, error) {
+	values, err := s.client.HGetAll(context.Background(), redisBansKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	bans := make(map[string]Ban)
+	for key, value := range values {
+		var ban Ban
+		if err := json.Unmarshal([]byte(value), &ban); err == nil {
+			bans[key] = ban
+		}
+	}
+	return bans, nil
+}
+
+func (s *RedisStore) LiftBans(identity string, ip string) (int, error) {
+	bans, err := s.allBans()
+	if err != nil {
+		return 0, err
+	}
+	lifted := make([]string, 0)
+	for key, ban := range bans {
+		if ban.Applies(identity, ip) {
+			lifted = append(lifted, key)
+		}
+	}
+	if len(lifted) == 0 {
+		return 0, nil
+	}
+	return len(lifted), s.client.HDel(context.Background(), redisBansKey, lifted...).Err()
+}
+
+func (s *RedisStore) Bans() ([]Ban, error) {
+	bans, err := s.allBans()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	active := make([]Ban, 0, len(bans))
+	expired := make([]string, 0)
+	for key, ban := range bans {
+		if ban.Active(now) {
+			active = append(active, ban)
+		} else {
+			expired = append(expired, key)
+		}
+	}
+	if len(expired) > 0 {
+		s.client.HDel(context.Background(), redisBansKey, expired...)
+	}
+	slices.SortFunc(active, func(a, b Ban) int { return int(a.Created - b.Created) })
+	return active, nil
+}
+
+func (s *RedisStore) FindBan(identity string, ip string) (*Ban, error) {
+	bans, err := s.Bans()
+	if err != nil {
+		return nil, err
+	}
+	for _, ban := range bans {
+		if ban.Applies(identity, ip) {
+			return &ban, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *RedisStore) AddReport(report Report) error {
+	packet, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return s.client.RPush(context.Background(), redisReportsKey, packet).Err()
+}
+
+func (s *RedisStore) Reports() ([]Report, error) {
+	values, err := s.client.LRange(context.Background(), redisReportsKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]Report, 0, len(values))
+	for _, value := range values {
+		var report Report
+		if err := json.Unmarshal([]byte(value), &report); err == nil {
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
@@ -2,46 +2,69 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"log"
 )
 
+// 24 bytes for the base64 encoded peer ID at the head of a relay message
+const relayPeerIDSize = 24
+
 type RelayMessage struct {
 	PeerID uuid.UUID
 	Packet []byte
 }
 
-func (h *Hub) SplitRelayMessage(message []byte, client *Client) RelayMessage {
-	networkPeerID := string(message[:24]) // 24 bytes for the base64 encoded relay message
+func (m *Match) SplitRelayMessage(message []byte, client *Client) (RelayMessage, error) {
+	if len(message) < relayPeerIDSize {
+		return RelayMessage{}, errors.New("relay message is too short to contain a peer ID")
+	}
+
+	networkPeerID := string(message[:relayPeerIDSize])
 	uidBytes, err := base64.StdEncoding.DecodeString(networkPeerID)
 	if err != nil {
 		log.Println("Error decoding peerID")
-		return RelayMessage{}
+		return RelayMessage{}, err
 	}
 
 	uid, err := uuid.FromBytes(uidBytes)
 	if err != nil {
 		log.Println("Error turning peer ID bytes into UUID")
-		return RelayMessage{}
+		return RelayMessage{}, err
 	}
 
-	senderBytes := make([]byte, 24)
+	senderBytes := make([]byte, relayPeerIDSize)
 	base64.StdEncoding.Encode(senderBytes, client.guid[:])
 
-	packet := senderBytes
-	log.Println(message[24:])                // Prepend with the senders uid
-	packet = append(packet, message[24:]...) // Append with the message itself
+	packet := senderBytes                                 // Prepend with the senders uid
+	packet = append(packet, message[relayPeerIDSize:]...) // Append with the message itself
 	return RelayMessage{
 		uid,
 		packet,
-	}
+	}, nil
 }
 
-func (h *Hub) HandleRelayMessage(message RelayMessage) error {
-	client := h.clients[message.PeerID.String()]
-	log.Println(client.username)
+// HandleRelayMessage delivers the packet to its target, which must be a player in the match
+// A nil peer ID broadcasts the packet to every other player and to the spectators
+func (m *Match) HandleRelayMessage(message RelayMessage, sender *Client) error {
+	if message.PeerID == uuid.Nil {
+		packet := append([]byte{RES_ID_RELAY_MSG}, message.Packet...)
+		for _, client := range m.Clients() {
+			if client != sender {
+				m.SendRelay(client, packet)
+			}
+		}
+		m.SendToSpectators(packet)
+		return nil
+	}
+
+	client := m.Client(message.PeerID.String())
+	if client == nil {
+		return fmt.Errorf("relay target %v is not in match %v", message.PeerID, m.Name())
+	}
 	packet := append([]byte{RES_ID_RELAY_MSG}, message.Packet...)
-	client.send <- packet
+	m.SendRelay(client, packet)
 
 	return nil
 }
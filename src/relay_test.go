@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowClientDisconnectDoesNotStallHub(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	slow := connect(t, hub, "username=slow")
+	hostAndJoin(t, host, slow)
+
+	// More packets than the slow client's send queue holds, so the match goroutine ends up waiting on it
+	fail := slow.transport.Stall()
+	packet := append([]byte{RELAY_PREFIX}, slow.id...)
+	packet = append(packet, "payload"...)
+	go func() {
+		for i := 0; i < 2*sendBufferSize; i++ {
+			host.Write(packet)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	fail()
+
+	host.Expect(RES_ID_PEER_DISCONNECTED)
+	stats := make(chan []ClientStats)
+	go func() { stats <- hub.ClientStats() }()
+	select {
+	case <-stats:
+	case <-time.After(2 * time.Second):
+		t.Fatal("hub stopped responding after a slow client's write failed")
+	}
+}
+
+// BenchmarkRelay relays packets through several matches at once, throughput should grow with the matches up to the number of cores
+func BenchmarkRelay(b *testing.B) {
+	for _, matches := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("matches=%d", matches), func(b *testing.B) {
+			hub := startHub()
+			hosts := make([]*testClient, matches)
+			peers := make([]*testClient, matches)
+			for i := range hosts {
+				hosts[i] = connect(b, hub, fmt.Sprintf("username=host%d", i))
+				peers[i] = connect(b, hub, fmt.Sprintf("username=peer%d", i))
+				hostAndJoin(b, hosts[i], peers[i])
+			}
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i := range hosts {
+				host, peer := hosts[i], peers[i]
+				packet := append([]byte{RELAY_PREFIX}, peer.id...)
+				packet = append(packet, make([]byte, 64)...)
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					for n := 0; n < b.N; n++ {
+						host.Write(packet)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					for n := 0; n < b.N; {
+						if message := <-peer.transport.written; message[0] == RES_ID_RELAY_MSG {
+							n++
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.ReportMetric(float64(matches*b.N)/b.Elapsed().Seconds(), "packets/s")
+		})
+	}
+}
+
+func TestTryRelayDropsWhenQueueIsFull(t *testing.T) {
+	hub := NewHub()
+	host, err := NewClient("host", hub, newPipeTransport(), make(chan []byte, sendBufferSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The match goroutine isn't running, so nothing drains the relay queue
+	match := NewMatch(MatchData{}, host, defaultMaxClients)
+	packet := []byte{RELAY_PREFIX}
+	for i := 0; i < relayBufferSize; i++ {
+		if !match.TryRelay(packet, host) {
+			t.Fatalf("packet %v dropped with room in the queue", i)
+		}
+	}
+	if match.TryRelay(packet, host) {
+		t.Error("packet queued past the relay buffer")
+	}
+}
+
+// Renaming a match races nothing in the match goroutine, which names the match when a relay target is missing
+func TestRenamingWhileRelaying(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	peer := connect(t, hub, "username=peer")
+	stranger := connect(t, hub, "username=stranger")
+	match := hostAndJoin(t, host, peer)
+
+	packet := append([]byte{RELAY_PREFIX}, stranger.id...)
+	packet = append(packet, "payload"...)
+	for i := 0; i < 20; i++ {
+		peer.Write(packet)
+		host.Command(map[string]any{"action": SET_MATCH_METADATA, "uuid": match, "name": fmt.Sprintf("arena %d", i)})
+	}
+
+	// Renaming has no response, a listing after it shows the hub got to the last one
+	host.Command(map[string]any{"action": LIST_MATCHES})
+	host.Expect(RES_ID_COMMAND_RES)
+	stranger.Command(map[string]any{"action": JOIN_MATCH, "name": "arena 19"})
+	host.Expect(RES_ID_PEER_CONNECTED)
+}
@@ -0,0 +1,167 @@
+/** Reliable relay packets are delivered in order, survive the target resuming its session, and end with a receipt for the sender
+
+Sender:   RELIABLE_PREFIX | target peer ID (24) | sender sequence (uint32 LE) | payload
+Target:   RES_ID_RELIABLE_MSG | sequence (uint32 LE) | sender peer ID (24) | payload
+Ack:      ACK_PREFIX | sequence (uint32 LE), acknowledging every packet up to and including it
+Receipt:  RES_ID_RECEIPT | RECEIPT_DELIVERED or RECEIPT_FAILED | sender sequence (uint32 LE) | target peer ID (24)
+
+The server numbers the reliable packets of each target and keeps them until the target acks them.
+When the target resumes its session the packets it hasn't acked are sent again in order, so targets drop any sequence they have already seen.
+A packet fails if its target isn't in the match, has too many packets waiting, or leaves without resuming.
+A nil target peer ID sends the packet to every other player, with a receipt for each.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+)
+
+const (
+	RECEIPT_DELIVERED = byte(0)
+	RECEIPT_FAILED    = byte(1)
+)
+
+const (
+	reliableSequenceSize = 4
+	// maxPendingReliable is how many unacked packets a target can have before new ones fail
+	maxPendingReliable = 1024
+)
+
+type pendingReliable struct {
+	seq    uint32
+	packet []byte
+	// The outbox of the sender, which follows it across resumes, for the receipt
+	sender    *ReliableOutbox
+	senderSeq uint32
+}
+
+// ReliableOutbox holds a client's unacked reliable packets, it outlives the connection when the client resumes its session
+// It is used by the match goroutine, the client's read pump and the hub, so it is guarded by mu
+type ReliableOutbox struct {
+	mu      sync.Mutex
+	client  *Client
+	lastSeq uint32
+	pending []pendingReliable
+}
+
+func NewReliableOutbox(client *Client) *ReliableOutbox {
+	return &ReliableOutbox{client: client}
+}
+
+// Send sends to whichever connection the outbox's client is currently on
+func (o *ReliableOutbox) Send(message []byte) {
+	o.mu.Lock()
+	client := o.client
+	o.mu.Unlock()
+
+	client.Send(message)
+}
+
+// Deliver numbers the packet, which starts with the sender's peer ID, and sends it to the client
+func (o *ReliableOutbox) Deliver(sender *ReliableOutbox, senderSeq uint32, packet []byte) {
+	o.mu.Lock()
+	if len(o.pending) >= maxPendingReliable {
+		target := o.client.guid
+		o.mu.Unlock()
+		sender.Send(receipt(RECEIPT_FAILED, senderSeq, target))
+		return
+	}
+
+	o.lastSeq++
+	message := []byte{RES_ID_RELIABLE_MSG}
+	message = binary.LittleEndian.AppendUint32(message, o.lastSeq)
+	message = append(message, packet...)
+	o.pending = append(o.pending, pendingReliable{seq: o.lastSeq, packet: message, sender: sender, senderSeq: senderSeq})
+	// Sending under the lock keeps a resume from resending older packets after this one
+	o.client.Send(message)
+	o.mu.Unlock()
+}
+
+// Ack drops every packet up to and including the sequence and sends their receipts
+func (o *ReliableOutbox) Ack(seq uint32) {
+	o.mu.Lock()
+	acked := 0
+	for acked < len(o.pending) && o.pending[acked].seq <= seq {
+		acked++
+	}
+	delivered := o.pending[:acked]
+	o.pending = o.pending[acked:]
+	target := o.client.guid
+	o.mu.Unlock()
+
+	// Receipts go out after unlocking, as the sender may be acking packets from this client at the same time
+	for _, packet := range delivered {
+		packet.sender.Send(receipt(RECEIPT_DELIVERED, packet.senderSeq, target))
+	}
+}
+
+// Attach moves the outbox to the connection the client resumed on and sends it every packet it hasn't acked
+func (o *ReliableOutbox) Attach(client *Client) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.client = client
+	for _, packet := range o.pending {
+		client.Send(packet.packet)
+	}
+}
+
+// FailAll sends a failed receipt for every packet the client never acked, once it is gone for good
+func (o *ReliableOutbox) FailAll() {
+	o.mu.Lock()
+	failed := o.pending
+	o.pending = nil
+	target := o.client.guid
+	o.mu.Unlock()
+
+	for _, packet := range failed {
+		packet.sender.Send(receipt(RECEIPT_FAILED, packet.senderSeq, target))
+	}
+}
+
+func receipt(status byte, senderSeq uint32, target uuid.UUID) []byte {
+	message := []byte{RES_ID_RECEIPT, status}
+	message = binary.LittleEndian.AppendUint32(message, senderSeq)
+	return base64.StdEncoding.AppendEncode(message, target[:])
+}
+
+// SplitReliableMessage takes the sender sequence out of a reliable relay message, leaving a plain relay message
+func SplitReliableMessage(message []byte) ([]byte, uint32, error) {
+	if len(message) < relayPeerIDSize+reliableSequenceSize {
+		return nil, 0, errors.New("reliable message is too short to contain a peer ID and sequence")
+	}
+	seq := binary.LittleEndian.Uint32(message[relayPeerIDSize:])
+	relay := append(message[:relayPeerIDSize:relayPeerIDSize], message[relayPeerIDSize+reliableSequenceSize:]...)
+	return relay, seq, nil
+}
+
+// HandleReliableMessage hands the packet to the outbox of its target, or of every other player for a broadcast
+// Spectators get broadcasts as plain relay packets, they don't ack
+func (m *Match) HandleReliableMessage(message RelayMessage, sender *Client, senderSeq uint32) error {
+	var targets []*Client
+	if message.PeerID == uuid.Nil {
+		for _, client := range m.Clients() {
+			if client != sender {
+				targets = append(targets, client)
+			}
+		}
+		m.SendToSpectators(append([]byte{RES_ID_RELAY_MSG}, message.Packet...))
+	} else if target := m.Client(message.PeerID.String()); target != nil {
+		targets = []*Client{target}
+	}
+
+	if len(targets) == 0 {
+		sender.reliable.Send(receipt(RECEIPT_FAILED, senderSeq, message.PeerID))
+		return fmt.Errorf("reliable target %v is not in match %v", message.PeerID, m.Name())
+	}
+	for _, target := range targets {
+		target.reliable.Deliver(sender.reliable, senderSeq, message.Packet)
+	}
+	return nil
+}
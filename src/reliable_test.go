@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// sendReliable sends a reliable packet with the sender sequence to the target
+func sendReliable(sender *testClient, target *testClient, seq uint32, payload string) {
+	packet := append([]byte{RELIABLE_PREFIX}, target.id...)
+	packet = binary.LittleEndian.AppendUint32(packet, seq)
+	sender.Write(append(packet, payload...))
+}
+
+// readReliable returns the sequence and payload of the next reliable packet the client gets
+func readReliable(tb testing.TB, client *testClient) (uint32, string) {
+	tb.Helper()
+	message := client.Expect(RES_ID_RELIABLE_MSG)
+	return binary.LittleEndian.Uint32(message[1:]), string(message[1+reliableSequenceSize+relayPeerIDSize:])
+}
+
+func ack(client *testClient, seq uint32) {
+	client.Write(binary.LittleEndian.AppendUint32([]byte{ACK_PREFIX}, seq))
+}
+
+// resume connects again with the client's resume token, once the hub has noticed the old connection drop
+func resume(tb testing.TB, hub *Hub, client *testClient) *testClient {
+	tb.Helper()
+	token := string(client.connected[26+2:])
+	client.transport.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		request, refusal := hub.Admit(url.Values{"version": {"2"}, "resume": {token}}, "127.0.0.1")
+		if refusal == nil {
+			resumed := &testClient{tb: tb, transport: newPipeTransport(), id: client.id}
+			hub.Connect(request, resumed.transport, false)
+			resumed.connected = resumed.Expect(RES_ID_CONFIRMATION)
+			return resumed
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("could not resume: %v", refusal.Reason)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReliableRedeliveryAfterResume(t *testing.T) {
+	setFlag(t, resumeWindow, time.Minute)
+	hub := startHub()
+	host := connect(t, hub, "username=host&version=2")
+	peer := connect(t, hub, "username=peer&version=2")
+	hostAndJoin(t, host, peer)
+
+	for seq := uint32(1); seq <= 3; seq++ {
+		sendReliable(host, peer, seq, "before")
+		if got, _ := readReliable(t, peer); got != seq {
+			t.Fatalf("got sequence %v, want %v", got, seq)
+		}
+	}
+	ack(peer, 1)
+	if receipt := host.Expect(RES_ID_RECEIPT); receipt[1] != RECEIPT_DELIVERED || binary.LittleEndian.Uint32(receipt[2:]) != 1 {
+		t.Fatalf("expected a delivered receipt for 1, got %q", receipt)
+	}
+
+	resumed := resume(t, hub, peer)
+	if string(resumed.connected[2:26]) != peer.id {
+		t.Fatalf("resumed under %q, want %q", resumed.connected[2:26], peer.id)
+	}
+	sendReliable(host, resumed, 4, "after")
+
+	// The unacked packets come again in order, followed by the new one
+	for _, want := range []struct {
+		seq     uint32
+		payload string
+	}{{2, "before"}, {3, "before"}, {4, "after"}} {
+		if seq, payload := readReliable(t, resumed); seq != want.seq || payload != want.payload {
+			t.Fatalf("got %v %q, want %v %q", seq, payload, want.seq, want.payload)
+		}
+	}
+	ack(resumed, 4)
+	for _, want := range []uint32{2, 3, 4} {
+		if receipt := host.Expect(RES_ID_RECEIPT); receipt[1] != RECEIPT_DELIVERED || binary.LittleEndian.Uint32(receipt[2:]) != want {
+			t.Fatalf("expected a delivered receipt for %v, got %q", want, receipt)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/** Replays stream a recording into a synthetic match at the pace it was recorded
+
+The client asking for the replay watches it as a spectator, and others can spectate it by its invite code.
+Nobody can play in a replay, and it ends once its last spectator leaves.
+Replays are marked as such in their descriptions and left out of match listings and the lobby.
+
+Spectators of a replay get the recorded peer and metadata notifications along with every relayed packet, targeted ones included.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+type ReplayMatch struct {
+	// GUID of the recorded match
+	UUID string `json:"uuid"`
+}
+
+func (h *Hub) HandleReplayMatch(client *Client, message ReplayMatch) error {
+	log.Println("Replay match requested...")
+
+	if *recordDir == "" {
+		client.SendError(ERR_BAD_COMMAND, "Recording is disabled on this server")
+		return nil
+	}
+	uid, err := DecodeUUID(message.UUID)
+	if err != nil {
+		return err
+	}
+	recording, err := OpenRecording(RecordingPath(uid))
+	if err != nil {
+		log.Println(err)
+		client.SendError(ERR_BAD_COMMAND, "Recording does not exist")
+		return nil
+	}
+
+	meta, err := h.NewMatchData(MatchData{Tags: []string{"replay"}})
+	if err != nil {
+		recording.Close()
+		return err
+	}
+	match := NewReplay(meta, client)
+	if !match.AddSpectator(client) {
+		recording.Close()
+		msg := "Max spectators reached"
+		log.Println(msg)
+		response := []byte{RES_ID_CONFIRMATION, CONF_FAILED_SPECTATE}
+		response = append(response, []byte(msg)...)
+		client.Send(response)
+		return nil
+	}
+	h.RemoveFromMatch(client)
+	h.matchmaker.Cancel(client)
+	h.StartMatch(match, client)
+
+	client.Notify(NewNotification(match.Description(), RES_ID_CONFIRMATION, CONF_SPECTATING))
+
+	go match.Replay(recording)
+	return nil
+}
+
+// NewReplay makes a match for the client to watch rather than play in, so it has no host and no players
+func NewReplay(meta MatchData, client *Client) *Match {
+	match := NewMatch(meta, client, 0)
+	match.replay = true
+	match.RemoveClient(client)
+	match.host = nil
+	return match
+}
+
+// Replay streams the recording to the spectators of the match until it runs out or the match stops
+func (m *Match) Replay(recording *RecordingReader) {
+	defer recording.Close()
+
+	started := time.Now()
+	for {
+		record, err := recording.Next()
+		if err == io.EOF {
+			log.Printf("Replay %v finished", m.Name())
+			return
+		} else if err != nil {
+			log.Printf("Replay %v stopped: %v", m.Name(), err)
+			return
+		}
+
+		select {
+		case <-time.After(time.Until(started.Add(record.Elapsed))):
+		case <-m.stopped:
+			return
+		}
+
+		if record.Kind == RECORD_RELAY {
+			notify := []byte{RES_ID_REPLAY_RELAY}
+			notify = base64.StdEncoding.AppendEncode(notify, record.Sender[:])
+			notify = base64.StdEncoding.AppendEncode(notify, record.Target[:])
+			notify = append(notify, record.Payload...)
+			for _, spectator := range m.Spectators() {
+				spectator.Send(notify)
+			}
+			continue
+		}
+
+		var resID byte
+		switch record.Kind {
+		case RECORD_JOIN:
+			resID = RES_ID_PEER_CONNECTED
+		case RECORD_LEAVE:
+			resID = RES_ID_PEER_DISCONNECTED
+		case RECORD_METADATA:
+			resID = RES_ID_REPLAY_METADATA
+		default:
+			log.Printf("Replay %v skipping unknown record kind %d", m.Name(), record.Kind)
+			continue
+		}
+		// Descriptions are recorded as JSON
+		notify := NewNotification(JSONValue(record.Payload), resID)
+		for _, spectator := range m.Spectators() {
+			spectator.Notify(notify)
+		}
+	}
+}
+
+// DumpRecording writes every record of a recording as a line of JSON, for reading a recording without replaying it
+func DumpRecording(path string) error {
+	recording, err := OpenRecording(path)
+	if err != nil {
+		return err
+	}
+	defer recording.Close()
+
+	kinds := map[byte]string{
+		RECORD_RELAY:    "relay",
+		RECORD_JOIN:     "join",
+		RECORD_LEAVE:    "leave",
+		RECORD_METADATA: "metadata",
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.Encode(map[string]any{
+		"match":   recording.Match.String(),
+		"started": recording.Started,
+	})
+	for {
+		record, err := recording.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		line := map[string]any{
+			"kind":    kinds[record.Kind],
+			"elapsed": record.Elapsed.Seconds(),
+			"sender":  record.Sender.String(),
+		}
+		if record.Kind == RECORD_RELAY {
+			line["target"] = record.Target.String()
+			// Relay payloads are opaque, so they are left base64 encoded
+			line["payload"] = record.Payload
+		} else {
+			line["payload"] = json.RawMessage(record.Payload)
+		}
+		if err := encoder.Encode(line); err != nil {
+			return fmt.Errorf("could not write record: %w", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestReplayHasNoHost(t *testing.T) {
+	setFlag(t, recordDir, t.TempDir())
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	host.Command(map[string]any{"action": HOST_MATCH, "record": true})
+	var recorded MatchDescription
+	if err := json.Unmarshal(host.Expect(RES_ID_CONFIRMATION)[2:], &recorded); err != nil {
+		t.Fatal(err)
+	}
+	host.Command(map[string]any{"action": LEAVE_MATCH, "uuid": recorded.Guid})
+	if left := host.Expect(RES_ID_CONFIRMATION); left[1] != CONF_LEFT_MATCH {
+		t.Fatalf("expected to leave the recorded match, got %q", left)
+	}
+
+	host.Command(map[string]any{"action": REPLAY_MATCH, "uuid": recorded.Guid})
+	spectating := host.Expect(RES_ID_CONFIRMATION)
+	if spectating[1] != CONF_SPECTATING {
+		t.Fatalf("expected to spectate the replay, got %q", spectating)
+	}
+	var replay MatchDescription
+	if err := json.Unmarshal(spectating[2:], &replay); err != nil {
+		t.Fatal(err)
+	}
+	if replay.Host != "" {
+		t.Errorf("replay is hosted by %q", replay.Host)
+	}
+
+	host.Command(map[string]any{"action": LOCK_MATCH, "locked": true})
+	if rejected := host.Expect(RES_ID_ERROR); string(rejected[2:]) != "Only the host can do that" {
+		t.Errorf("spectator of a replay got %q locking it", rejected)
+	}
+}
+
+func TestReplaysAreNotListed(t *testing.T) {
+	setFlag(t, recordDir, t.TempDir())
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	host.Command(map[string]any{"action": HOST_MATCH, "record": true})
+	var recorded MatchDescription
+	if err := json.Unmarshal(host.Expect(RES_ID_CONFIRMATION)[2:], &recorded); err != nil {
+		t.Fatal(err)
+	}
+	viewer := connect(t, hub, "username=viewer")
+	viewer.Command(map[string]any{"action": REPLAY_MATCH, "uuid": recorded.Guid})
+	var replay MatchDescription
+	if err := json.Unmarshal(viewer.Expect(RES_ID_CONFIRMATION)[2:], &replay); err != nil {
+		t.Fatal(err)
+	}
+	if !replay.Replay {
+		t.Errorf("replay isn't marked as one: %+v", replay)
+	}
+
+	browser := connect(t, hub, "username=browser")
+	browser.Command(map[string]any{"action": LIST_MATCHES})
+	var listing MatchListing
+	if err := json.Unmarshal(browser.Expect(RES_ID_COMMAND_RES)[1:], &listing); err != nil {
+		t.Fatal(err)
+	}
+	browser.Command(map[string]any{"action": SUBSCRIBE_LOBBY})
+	var lobby LobbyUpdate
+	if err := json.Unmarshal(browser.Expect(RES_ID_LOBBY_UPDATE)[1:], &lobby); err != nil {
+		t.Fatal(err)
+	}
+	// Only the recorded match, which is still going
+	if len(listing.Matches) != 1 || len(lobby.Created) != 1 {
+		t.Errorf("listed %+v, lobby %+v", listing.Matches, lobby.Created)
+	}
+}
+
+func TestReplayNeedsRoomForItsViewer(t *testing.T) {
+	setFlag(t, recordDir, t.TempDir())
+	setFlag(t, maxSpectators, 0)
+	hub := startHub()
+	viewer := connect(t, hub, "username=viewer")
+	viewer.Command(map[string]any{"action": HOST_MATCH, "record": true})
+	var recorded MatchDescription
+	if err := json.Unmarshal(viewer.Expect(RES_ID_CONFIRMATION)[2:], &recorded); err != nil {
+		t.Fatal(err)
+	}
+	viewer.Command(map[string]any{"action": REPLAY_MATCH, "uuid": recorded.Guid})
+	if refused := viewer.Expect(RES_ID_CONFIRMATION); refused[1] != CONF_FAILED_SPECTATE {
+		t.Errorf("got %q", refused)
+	}
+}
@@ -0,0 +1,101 @@
+/** Sessions let a client that lost its connection pick up where it left off
+
+When -resume-window is set, the connected confirmation of protocol version 2 clients carries FEATURE_RESUME and a resume token.
+A client that disconnects is detached rather than removed: it keeps its GUID, match, party and unacked reliable packets for the resume window.
+Connecting again with ?resume=<token> within the window reattaches it under the same GUID and resends its unacked reliable packets.
+
+Other messages sent while a client is detached are lost, and its place in the matchmaking queue is given up.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"slices"
+	"time"
+)
+
+const resumeTokenSize = 16
+
+// sessionClaim asks the hub for the detached client a resume token belongs to, nil if there is none
+type sessionClaim struct {
+	token string
+	reply chan *Client
+}
+
+func NewResumeToken() string {
+	token := make([]byte, resumeTokenSize)
+	rand.Read(token)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// ClaimSession takes a detached client off the expiry list so it can be resumed on a new connection
+func (h *Hub) ClaimSession(token string) *Client {
+	claim := sessionClaim{token: token, reply: make(chan *Client, 1)}
+	h.claims <- claim
+	return <-claim.reply
+}
+
+func (h *Hub) HandleClaim(claim sessionClaim) {
+	client := h.sessions[claim.token]
+	if _, detached := h.detached[client]; !detached {
+		claim.reply <- nil
+		return
+	}
+	delete(h.detached, client)
+	claim.reply <- client
+}
+
+// Detach keeps the client's place for the resume window after its connection drops
+func (h *Hub) Detach(client *Client) {
+	log.Printf("Detaching user with GUID %v, username %v, for %v", client.guid, client.username, *resumeWindow)
+	client.Close()
+	h.detached[client] = time.Now().Add(*resumeWindow)
+
+	h.matchmaker.Cancel(client)
+	if party := h.partyByClient[client]; party != nil {
+		h.matchmaker.Cancel(party.Leader())
+	}
+	delete(h.subscriptions, client)
+}
+
+// ExpireSessions removes the detached clients whose resume window has passed
+func (h *Hub) ExpireSessions(now time.Time) {
+	for client, expires := range h.detached {
+		if now.After(expires) {
+			log.Printf("Resume window of %v passed", client.username)
+			h.Disconnect(client)
+		}
+	}
+}
+
+// Resume puts the new connection in place of the detached client everywhere the hub refers to it
+func (h *Hub) Resume(old *Client, client *Client) {
+	log.Printf("Resuming user with GUID %v, username %v", client.guid, client.username)
+	h.clients[client.guid.String()] = client
+	h.sessions[client.resumeToken] = client
+	h.udp.Remove(old)
+
+	if match := h.matchByClient[old]; match != nil {
+		delete(h.matchByClient, old)
+		h.matchByClient[client] = match
+		match.ReplaceClient(client)
+		if match.host == old {
+			match.host = client
+		}
+		client.match.Store(match)
+	}
+	if party := h.partyByClient[old]; party != nil {
+		delete(h.partyByClient, old)
+		h.partyByClient[client] = party
+		party.members[slices.Index(party.members, old)] = client
+	}
+	for _, party := range h.parties {
+		if party.invited[old] {
+			delete(party.invited, old)
+			party.invited[client] = true
+		}
+	}
+}
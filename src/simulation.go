@@ -0,0 +1,111 @@
+/** Offline simulation of the matchmaker, used to tune the rating window flags without live players
+
+Run the server with -simulate-matchmaking to print a report instead of listening.
+The simulation reads the same matchmaking flags as the server, but runs on a simulated clock with a seeded population so a run is repeatable.
+*/
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	simulatedRatingMean   = 1500
+	simulatedRatingStdDev = 300
+)
+
+type SimulationReport struct {
+	Players  int `json:"players"`
+	Matches  int `json:"matches"`
+	Matched  int `json:"matched"`
+	TimedOut int `json:"timed_out"`
+	// Seconds spent in the queue by matched players
+	MeanWait float64 `json:"mean_wait"`
+	MaxWait  float64 `json:"max_wait"`
+	// Mean gap between the highest and lowest rated player of a match
+	MeanRatingSpread float64 `json:"mean_rating_spread"`
+	// Mean gap between the highest and lowest team rating total of a match
+	MeanTeamGap float64 `json:"mean_team_gap"`
+	// Mean seconds between the wait estimate given when queueing and the actual wait, for players that got one
+	MeanEstimateError float64 `json:"mean_estimate_error"`
+}
+
+// SimulateMatchmaking queues a seeded population of players arriving at the given rate per second and runs the matchmaker until the queue drains
+func SimulateMatchmaking(seed int64, players int, arrivalRate float64, criteria QueueMatch) SimulationReport {
+	rng := rand.New(rand.NewSource(seed))
+	matchmaker := NewMatchmaker(nil)
+	report := SimulationReport{Players: players}
+
+	estimates := make(map[*Ticket]time.Duration)
+	var totalWait, totalSpread, totalTeamGap, totalEstimateError float64
+	var estimated int
+
+	now := time.Unix(0, 0)
+	nextArrival := now
+	arrived := 0
+	for arrived < players || len(matchmaker.tickets) > 0 {
+		for arrived < players && !nextArrival.After(now) {
+			rating := simulatedRatingMean + rng.NormFloat64()*simulatedRatingStdDev
+			ticketCriteria := criteria
+			ticketCriteria.Rating = &rating
+			ticket := &Ticket{
+				criteria: ticketCriteria,
+				queued:   nextArrival,
+				expires:  nextArrival.Add(*queueTimeout),
+			}
+			if estimate, ok := matchmaker.waits[ticket.key()]; ok {
+				estimates[ticket] = estimate
+			}
+			matchmaker.tickets = append(matchmaker.tickets, ticket)
+
+			arrived++
+			nextArrival = nextArrival.Add(time.Duration(rng.ExpFloat64() / arrivalRate * float64(time.Second)))
+		}
+
+		report.TimedOut += len(matchmaker.expire(now))
+		for _, group := range matchmaker.form(now) {
+			report.Matches++
+			lowest, highest := math.Inf(1), math.Inf(-1)
+			teams := make([]float64, criteria.Teams)
+			for _, ticket := range group {
+				wait := now.Sub(ticket.queued)
+				totalWait += wait.Seconds()
+				report.MaxWait = max(report.MaxWait, wait.Seconds())
+				if estimate, ok := estimates[ticket]; ok {
+					totalEstimateError += math.Abs((wait - estimate).Seconds())
+					estimated++
+				}
+
+				lowest = min(lowest, ticket.rating())
+				highest = max(highest, ticket.rating())
+				teams[ticket.team] += ticket.rating()
+			}
+			report.Matched += len(group)
+			totalSpread += highest - lowest
+
+			weakest, strongest := math.Inf(1), math.Inf(-1)
+			for _, total := range teams {
+				weakest = min(weakest, total)
+				strongest = max(strongest, total)
+			}
+			totalTeamGap += strongest - weakest
+		}
+
+		now = now.Add(*matchmakingInterval)
+	}
+
+	if report.Matched > 0 {
+		report.MeanWait = totalWait / float64(report.Matched)
+	}
+	if report.Matches > 0 {
+		report.MeanRatingSpread = totalSpread / float64(report.Matches)
+		report.MeanTeamGap = totalTeamGap / float64(report.Matches)
+	}
+	if estimated > 0 {
+		report.MeanEstimateError = totalEstimateError / float64(estimated)
+	}
+	return report
+}
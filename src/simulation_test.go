@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var simulatedCriteria = QueueMatch{MatchSize: 4, Teams: 2}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	first := SimulateMatchmaking(1, 200, 2, simulatedCriteria)
+	second := SimulateMatchmaking(1, 200, 2, simulatedCriteria)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("the same seed gave different reports:\n%+v\n%+v", first, second)
+	}
+	if other := SimulateMatchmaking(2, 200, 2, simulatedCriteria); reflect.DeepEqual(first, other) {
+		t.Errorf("different seeds gave the same report %+v", first)
+	}
+	if first.Matched+first.TimedOut != first.Players || first.Matched != first.Matches*simulatedCriteria.MatchSize {
+		t.Errorf("players are unaccounted for in %+v", first)
+	}
+}
+
+func TestSimulationWidensRatingWindows(t *testing.T) {
+	// Players arrive slowly, so most only find a match once their window has widened
+	setFlag(t, ratingWindowGrowth, 0)
+	fixed := SimulateMatchmaking(1, 200, 0.2, simulatedCriteria)
+	setFlag(t, ratingWindowGrowth, 10)
+	widening := SimulateMatchmaking(1, 200, 0.2, simulatedCriteria)
+
+	if fixed.MeanRatingSpread > *ratingWindow {
+		t.Errorf("mean rating spread %v is wider than the fixed window %v", fixed.MeanRatingSpread, *ratingWindow)
+	}
+	if widening.Matched <= fixed.Matched {
+		t.Errorf("widening windows matched %v players, no more than the %v of a fixed window", widening.Matched, fixed.Matched)
+	}
+	if widening.MeanRatingSpread <= *ratingWindow {
+		t.Errorf("mean rating spread %v never went past the starting window %v", widening.MeanRatingSpread, *ratingWindow)
+	}
+}
+
+func TestSimulationBalancesTeams(t *testing.T) {
+	report := SimulateMatchmaking(1, 200, 2, simulatedCriteria)
+	if report.Matches == 0 {
+		t.Fatal("no matches were formed")
+	}
+	// Greedy balancing pairs the strongest player with the weakest, so the teams are closer than the players in them
+	if report.MeanTeamGap >= report.MeanRatingSpread {
+		t.Errorf("mean team gap %v is no smaller than the mean rating spread %v", report.MeanTeamGap, report.MeanRatingSpread)
+	}
+}
@@ -0,0 +1,82 @@
+/** Spectators watch a match without playing in it
+
+Spectators join by the same UUID, invite code or name as players, but take no seat, so a full match can still be watched.
+They receive the server's match notifications and every broadcast relay packet, held back by the spectator delay if one is set.
+Relay packets sent by a spectator are dropped.
+A spectator that joins the match it is watching becomes a player.
+*/
+
+package main
+
+import (
+	"log"
+)
+
+func (h *Hub) HandleSpectateMatch(client *Client, spectate JoinMatch) error {
+	log.Println("Spectate match requested...")
+
+	candidates, err := h.ResolveMatch(spectate)
+	if err != nil {
+		return err
+	}
+	if len(candidates) > 1 {
+		return SendAmbiguousMatch(client, candidates)
+	}
+
+	var match *Match
+	var msg string
+	if len(candidates) == 1 {
+		match = candidates[0]
+	}
+	switch {
+	case match == nil:
+		msg = "Match does not exist"
+	case match.Client(client.guid.String()) != nil:
+		msg = "Already playing in match"
+	case match.Spectator(client.guid.String()) != nil:
+		msg = "Already spectating match"
+	case match.Refuses([]*Client{client}) != "":
+		msg = match.Refuses([]*Client{client})
+	case !match.AddSpectator(client):
+		msg = "Max spectators reached"
+	}
+	if msg != "" {
+		log.Println(msg)
+		response := []byte{RES_ID_CONFIRMATION, CONF_FAILED_SPECTATE}
+		response = append(response, []byte(msg)...)
+		client.Send(response)
+		return nil
+	}
+
+	h.RemoveFromMatch(client)
+	h.matchmaker.Cancel(client)
+	h.matchByClient[client] = match
+	client.match.Store(match)
+	delete(h.subscriptions, client)
+	h.LobbyChanged(match)
+
+	client.Notify(NewNotification(match.Description(), RES_ID_CONFIRMATION, CONF_SPECTATING))
+
+	// Catch the spectator up on who is already there, players and spectators apart
+	for _, player := range match.Clients() {
+		sendPeer(client, RES_ID_PEER_CONNECTED, player)
+	}
+	for _, spectator := range match.Spectators() {
+		if spectator == client {
+			continue
+		}
+		sendPeer(client, RES_ID_SPECTATOR_CONNECTED, spectator)
+	}
+	match.chatHistory.SendTo(client)
+	if err := SendStateSnapshot(match, client); err != nil {
+		return err
+	}
+
+	match.Broadcast(NewNotification(client.Description(), RES_ID_SPECTATOR_CONNECTED))
+	return nil
+}
+
+// sendPeer tells the client about a peer with a connected or disconnected notification
+func sendPeer(client *Client, resID byte, peer *Client) {
+	client.Notify(NewNotification(peer.PeerDescription(), resID))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+func TestSpectatorCap(t *testing.T) {
+	setFlag(t, maxSpectators, 1)
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	players := []*testClient{connect(t, hub, "username=p1"), connect(t, hub, "username=p2"), connect(t, hub, "username=p3")}
+	match := hostAndJoin(t, host, players...)
+
+	// A full match can still be watched, spectators take no seat
+	watcher := connect(t, hub, "username=watcher")
+	watcher.Command(map[string]any{"action": SPECTATE_MATCH, "uuid": match})
+	if spectating := watcher.Expect(RES_ID_CONFIRMATION); spectating[1] != CONF_SPECTATING {
+		t.Fatalf("got %q spectating a full match", spectating)
+	}
+	host.Expect(RES_ID_SPECTATOR_CONNECTED)
+
+	late := connect(t, hub, "username=late")
+	late.Command(map[string]any{"action": SPECTATE_MATCH, "uuid": match})
+	if refused := late.Expect(RES_ID_CONFIRMATION); refused[1] != CONF_FAILED_SPECTATE || string(refused[2:]) != "Max spectators reached" {
+		t.Errorf("got %q spectating past the cap", refused)
+	}
+}
+
+func TestSpectatorsAreReadOnly(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	watcher := connect(t, hub, "username=watcher")
+	match := hostAndJoin(t, host)
+	watcher.Command(map[string]any{"action": SPECTATE_MATCH, "uuid": match})
+	watcher.Expect(RES_ID_CONFIRMATION)
+	host.Expect(RES_ID_SPECTATOR_CONNECTED)
+
+	packet := append([]byte{RELAY_PREFIX}, host.id...)
+	packet = append(packet, "from the stands"...)
+	watcher.Write(packet)
+	if rejected := watcher.Expect(RES_ID_ERROR); rejected[1] != ERR_SPECTATING {
+		t.Errorf("got %q relaying as a spectator", rejected)
+	}
+
+	// Broadcasts still reach the spectator, and the spectator's packet never reached the host
+	broadcast := append([]byte{RELAY_PREFIX}, base64.StdEncoding.EncodeToString(uuid.Nil[:])...)
+	broadcast = append(broadcast, "to everyone"...)
+	host.Write(broadcast)
+	if relayed := watcher.Expect(RES_ID_RELAY_MSG); string(relayed[1+relayPeerIDSize:]) != "to everyone" {
+		t.Errorf("spectator got %q", relayed)
+	}
+	select {
+	case message := <-host.transport.written:
+		t.Errorf("host got %q", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
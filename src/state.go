@@ -0,0 +1,223 @@
+/** Match state is a key/value document the server keeps for each match, so no single client has to be trusted with it
+
+Players set and delete keys with commands, and every change is broadcast to the match.
+Clients that join or spectate later get the whole document first.
+
+Each write gives the key a new version, unique within the match, and snapshots carry the latest version so older changes can be ignored.
+Sending the version last seen makes a write compare-and-set, going through only if the key is still at that version.
+Version 0 means the key must not exist yet.
+
+The permission a key is created with decides who may write it afterwards:
+- public: any player
+- owner: the player that created it
+- host: only the host
+The host can write every key, and spectators can't write any.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+)
+
+const (
+	STATE_PUBLIC = "public"
+	STATE_OWNER  = "owner"
+	STATE_HOST   = "host"
+)
+
+const maxStateKeyLength = 128
+
+// SetState creates or replaces a key, Version makes it a compare-and-set
+type SetState struct {
+	Key   string `json:"key"`
+	Value Value  `json:"value"`
+	// Only used when the key is created, defaults to public
+	Permission string  `json:"permission"`
+	Version    *uint64 `json:"version"`
+}
+
+// DeleteState removes a key, Version makes it a compare-and-delete
+type DeleteState struct {
+	Key     string  `json:"key"`
+	Version *uint64 `json:"version"`
+}
+
+type StateEntry struct {
+	Value      Value  `json:"value"`
+	Version    uint64 `json:"version"`
+	Permission string `json:"permission"`
+	// UUID of the player that created the key
+	Owner string `json:"owner"`
+}
+
+// StateChange is broadcast to the match whenever a key is written
+type StateChange struct {
+	Key string `json:"key"`
+	// Omitted when the key was deleted
+	Entry   *StateEntry `json:"entry,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+	// Changes at or below the version of a snapshot are already part of it
+	Version uint64 `json:"version"`
+	// UUID of the player that made the change
+	By string `json:"by"`
+}
+
+type StateSnapshot struct {
+	Version uint64                 `json:"version"`
+	Entries map[string]*StateEntry `json:"entries"`
+}
+
+// StateRejection tells a client why its write didn't go through, along with the key's current version, 0 if it doesn't exist
+type StateRejection struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+	Message string `json:"message"`
+}
+
+// MatchState belongs to the hub goroutine
+type MatchState struct {
+	entries map[string]*StateEntry
+	// The last version handed out
+	version uint64
+}
+
+func NewMatchState() *MatchState {
+	return &MatchState{entries: make(map[string]*StateEntry)}
+}
+
+// canWrite returns why the client can't write the key, empty if it can
+func (m *Match) canWrite(client *Client, entry *StateEntry) string {
+	if m.Client(client.guid.String()) == nil {
+		return "Only players can change match state"
+	}
+	if entry == nil || m.host == client {
+		return ""
+	}
+	switch entry.Permission {
+	case STATE_HOST:
+		return "Only the host can change this key"
+	case STATE_OWNER:
+		if entry.Owner != base64.StdEncoding.EncodeToString(client.guid[:]) {
+			return "Only the owner can change this key"
+		}
+	}
+	return ""
+}
+
+func (h *Hub) HandleSetState(client *Client, message SetState) error {
+	log.Println("Set state requested...")
+
+	match := h.matchByClient[client]
+	if match == nil {
+		client.SendError(ERR_BAD_COMMAND, "Not in a match")
+		return nil
+	}
+	state := match.state
+	entry := state.entries[message.Key]
+
+	var msg string
+	switch {
+	case message.Key == "" || len(message.Key) > maxStateKeyLength:
+		msg = fmt.Sprintf("Keys must be 1 to %d bytes", maxStateKeyLength)
+	case message.Value.Len() == 0:
+		msg = "A value is required"
+	case !message.Value.Convertible():
+		msg = "Value must be representable in JSON"
+	case entry == nil && len(state.entries) >= *maxStateKeys:
+		msg = fmt.Sprintf("Matches are limited to %d keys", *maxStateKeys)
+	case message.Permission != "" && message.Permission != STATE_PUBLIC && message.Permission != STATE_OWNER && message.Permission != STATE_HOST:
+		msg = fmt.Sprintf("Unknown permission %q", message.Permission)
+	case entry == nil && message.Permission == STATE_HOST && match.host != client:
+		msg = "Only the host can create host keys"
+	default:
+		msg = match.canWrite(client, entry)
+	}
+	if msg == "" && message.Version != nil && *message.Version != entry.currentVersion() {
+		msg = "Key has changed"
+	}
+	if msg != "" {
+		return rejectState(client, message.Key, entry, msg)
+	}
+
+	state.version++
+	if entry == nil {
+		entry = &StateEntry{
+			Permission: message.Permission,
+			Owner:      base64.StdEncoding.EncodeToString(client.guid[:]),
+		}
+		if entry.Permission == "" {
+			entry.Permission = STATE_PUBLIC
+		}
+		state.entries[message.Key] = entry
+	}
+	entry.Value = message.Value
+	entry.Version = state.version
+
+	return broadcastStateChange(match, client, StateChange{Key: message.Key, Entry: entry})
+}
+
+func (h *Hub) HandleDeleteState(client *Client, message DeleteState) error {
+	log.Println("Delete state requested...")
+
+	match := h.matchByClient[client]
+	if match == nil {
+		client.SendError(ERR_BAD_COMMAND, "Not in a match")
+		return nil
+	}
+	entry := match.state.entries[message.Key]
+
+	var msg string
+	if entry == nil {
+		msg = "Key does not exist"
+	} else {
+		msg = match.canWrite(client, entry)
+	}
+	if msg == "" && message.Version != nil && *message.Version != entry.currentVersion() {
+		msg = "Key has changed"
+	}
+	if msg != "" {
+		return rejectState(client, message.Key, entry, msg)
+	}
+
+	delete(match.state.entries, message.Key)
+	match.state.version++
+	return broadcastStateChange(match, client, StateChange{Key: message.Key, Deleted: true})
+}
+
+// currentVersion is the version compare-and-set checks against, 0 for a key that doesn't exist
+func (e *StateEntry) currentVersion() uint64 {
+	if e == nil {
+		return 0
+	}
+	return e.Version
+}
+
+func rejectState(client *Client, key string, entry *StateEntry, msg string) error {
+	log.Println(msg)
+	client.Notify(NewNotification(StateRejection{Key: key, Version: entry.currentVersion(), Message: msg}, RES_ID_ERROR, ERR_STATE_REJECTED))
+	return nil
+}
+
+func broadcastStateChange(match *Match, client *Client, change StateChange) error {
+	change.Version = match.state.version
+	change.By = base64.StdEncoding.EncodeToString(client.guid[:])
+	// The match goroutine encodes the change, so it gets a copy of the entry the hub goes on changing
+	if change.Entry != nil {
+		entry := *change.Entry
+		change.Entry = &entry
+	}
+	match.Broadcast(NewNotification(change, RES_ID_STATE_UPDATE))
+	return nil
+}
+
+// SendStateSnapshot gives a client that just came into the match the whole document, if there is one
+func SendStateSnapshot(match *Match, client *Client) error {
+	if len(match.state.entries) == 0 {
+		return nil
+	}
+	client.Notify(NewNotification(StateSnapshot{Version: match.state.version, Entries: match.state.entries}, RES_ID_STATE_SNAPSHOT))
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// setState writes a key and returns the change broadcast for it, or the rejection the writer got
+func setState(tb testing.TB, writer *testClient, command map[string]any) (*StateChange, *StateRejection) {
+	tb.Helper()
+	writer.Command(command)
+	for {
+		message := writer.Read()
+		switch {
+		case message[0] == RES_ID_ERROR && message[1] == ERR_STATE_REJECTED:
+			var rejection StateRejection
+			if err := json.Unmarshal(message[2:], &rejection); err != nil {
+				tb.Fatal(err)
+			}
+			return nil, &rejection
+		case message[0] == RES_ID_STATE_UPDATE:
+			var change StateChange
+			if err := json.Unmarshal(message[1:], &change); err != nil {
+				tb.Fatal(err)
+			}
+			// Changes other players made earlier are still queued ahead of the writer's own
+			if change.By == writer.id {
+				return &change, nil
+			}
+		}
+	}
+}
+
+func TestStateCompareAndSet(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	peer := connect(t, hub, "username=peer")
+	hostAndJoin(t, host, peer)
+
+	// Version 0 creates the key only if it doesn't exist
+	created, _ := setState(t, host, map[string]any{"action": SET_STATE, "key": "round", "value": 1, "version": 0})
+	if created == nil {
+		t.Fatal("creating the key was rejected")
+	}
+	version := created.Entry.Version
+	if _, rejection := setState(t, peer, map[string]any{"action": SET_STATE, "key": "round", "value": 1, "version": 0}); rejection == nil || rejection.Message != "Key has changed" || rejection.Version != version {
+		t.Errorf("creating an existing key got %+v", rejection)
+	}
+
+	updated, _ := setState(t, peer, map[string]any{"action": SET_STATE, "key": "round", "value": 2, "version": version})
+	if updated == nil || updated.Entry.Version <= version || string(updated.Entry.Value.raw) != "2" {
+		t.Fatalf("compare-and-set at the current version got %+v", updated)
+	}
+	// The host's view is now stale
+	if _, rejection := setState(t, host, map[string]any{"action": SET_STATE, "key": "round", "value": 3, "version": version}); rejection == nil || rejection.Version != updated.Entry.Version {
+		t.Errorf("stale compare-and-set got %+v", rejection)
+	}
+	// Without a version the write always goes through
+	if change, _ := setState(t, host, map[string]any{"action": SET_STATE, "key": "round", "value": 3}); change == nil {
+		t.Error("unconditional write was rejected")
+	}
+}
+
+func TestStatePermissions(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	owner := connect(t, hub, "username=owner")
+	other := connect(t, hub, "username=other")
+	watcher := connect(t, hub, "username=watcher")
+	match := hostAndJoin(t, host, owner, other)
+	watcher.Command(map[string]any{"action": SPECTATE_MATCH, "uuid": match})
+	watcher.Expect(RES_ID_CONFIRMATION)
+
+	if change, _ := setState(t, owner, map[string]any{"action": SET_STATE, "key": "loadout", "value": "sword", "permission": STATE_OWNER}); change == nil || change.Entry.Owner != owner.id {
+		t.Fatalf("creating an owner key got %+v", change)
+	}
+	tests := []struct {
+		name    string
+		writer  *testClient
+		command map[string]any
+		// Empty when the write goes through
+		rejected string
+	}{
+		{"other player", other, map[string]any{"action": SET_STATE, "key": "loadout", "value": "axe"}, "Only the owner can change this key"},
+		{"other player deleting", other, map[string]any{"action": DELETE_STATE, "key": "loadout"}, "Only the owner can change this key"},
+		{"spectator", watcher, map[string]any{"action": SET_STATE, "key": "loadout", "value": "axe"}, "Only players can change match state"},
+		{"player creating a host key", other, map[string]any{"action": SET_STATE, "key": "rules", "value": "ffa", "permission": STATE_HOST}, "Only the host can create host keys"},
+		{"host", host, map[string]any{"action": SET_STATE, "key": "loadout", "value": "bow"}, ""},
+		{"owner deleting", owner, map[string]any{"action": DELETE_STATE, "key": "loadout"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			change, rejection := setState(t, test.writer, test.command)
+			if test.rejected == "" && change == nil {
+				t.Errorf("rejected with %+v", rejection)
+			}
+			if test.rejected != "" && (rejection == nil || rejection.Message != test.rejected) {
+				t.Errorf("got %+v, want %q", rejection, test.rejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+/** Raw TCP transport for native clients and bots that would rather not speak websockets
+
+Started with -tcp-addr, it shares the hub and matches with websocket clients.
+
+Frame: kind | length (uint32 LE) | payload
+
+Kinds:
+- message: one message, exactly as it would be sent over a websocket
+- ping and pong: a pong carries back the payload of its ping, either side can ping
+- close: the other side is closing the connection, the payload says why
+
+The first frame from a client must be a message holding the query string a websocket client would connect with, like username=bob or resume=<token>.
+If the server turns the client away it sends a close frame with the reason.
+TCP connections aren't compressed, and messages are bound by -max-frame-size.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	TCP_FRAME_MESSAGE = byte(0)
+	TCP_FRAME_PING    = byte(1)
+	TCP_FRAME_PONG    = byte(2)
+	TCP_FRAME_CLOSE   = byte(3)
+)
+
+const (
+	tcpFrameHeaderSize = 5
+	// Pings, pongs and closes are small, like websocket control frames
+	maxTCPControlSize = 125
+	tcpHelloTimeout   = 10 * time.Second
+)
+
+type tcpTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// What is left of the last message handed out, skipped before the next frame is read
+	current *io.LimitedReader
+	// The read pump answers pings while the write pump writes
+	writeMu sync.Mutex
+	onPong  func(payload []byte)
+}
+
+func NewTCPTransport(conn net.Conn) *tcpTransport {
+	return &tcpTransport{conn: conn, reader: bufio.NewReader(conn), onPong: func([]byte) {}}
+}
+
+func (t *tcpTransport) NextReader() (io.Reader, error) {
+	if t.current != nil {
+		if _, err := io.Copy(io.Discard, t.current); err != nil {
+			return nil, err
+		}
+		t.current = nil
+	}
+
+	for {
+		header := make([]byte, tcpFrameHeaderSize)
+		if _, err := io.ReadFull(t.reader, header); err != nil {
+			return nil, err
+		}
+		kind, length := header[0], int64(binary.LittleEndian.Uint32(header[1:]))
+
+		if kind == TCP_FRAME_MESSAGE {
+			if length > *maxFrameSize {
+				return nil, fmt.Errorf("tcp frame of %d bytes is over the limit of %d", length, *maxFrameSize)
+			}
+			t.current = &io.LimitedReader{R: t.reader, N: length}
+			return t.current, nil
+		}
+
+		if length > maxTCPControlSize {
+			return nil, fmt.Errorf("tcp control frame of %d bytes is over the limit of %d", length, maxTCPControlSize)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(t.reader, payload); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case TCP_FRAME_PING:
+			if err := t.writeFrame(TCP_FRAME_PONG, payload); err != nil {
+				return nil, err
+			}
+		case TCP_FRAME_PONG:
+			t.onPong(payload)
+		case TCP_FRAME_CLOSE:
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("unknown tcp frame kind %d", kind)
+		}
+	}
+}
+
+func (t *tcpTransport) writeFrame(kind byte, payload []byte) error {
+	frame := make([]byte, 0, tcpFrameHeaderSize+len(payload))
+	frame = append(frame, kind)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err := t.conn.Write(frame)
+	return err
+}
+
+func (t *tcpTransport) WriteMessage(message []byte) error {
+	return t.writeFrame(TCP_FRAME_MESSAGE, message)
+}
+
+func (t *tcpTransport) Ping(payload []byte) error {
+	return t.writeFrame(TCP_FRAME_PING, payload)
+}
+
+func (t *tcpTransport) SetPongHandler(handler func(payload []byte)) {
+	t.onPong = handler
+}
+
+func (t *tcpTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *tcpTransport) SetWriteDeadline(deadline time.Time) error {
+	return t.conn.SetWriteDeadline(deadline)
+}
+
+func (t *tcpTransport) WriteClose() error {
+	return t.writeFrame(TCP_FRAME_CLOSE, nil)
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// ServeTCP accepts TCP clients until the listener is closed
+func ServeTCP(hub *Hub, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			log.Println("Could not accept tcp connection: ", err)
+			continue
+		}
+		go serveTCPConn(hub, conn)
+	}
+}
+
+func serveTCPConn(hub *Hub, conn net.Conn) {
+	log.Println("Serving a tcp client")
+	transport := NewTCPTransport(conn)
+
+	conn.SetReadDeadline(time.Now().Add(tcpHelloTimeout))
+	query, err := readTCPHello(transport)
+	if err != nil {
+		log.Println("Could not read tcp hello: ", err)
+		conn.Close()
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	request, refusal := hub.Admit(query, ip)
+	if refusal != nil {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		transport.writeFrame(TCP_FRAME_CLOSE, []byte(refusal.Reason))
+		conn.Close()
+		return
+	}
+	hub.Connect(request, transport, false)
+}
+
+// readTCPHello reads the query string that opens a tcp connection
+func readTCPHello(transport *tcpTransport) (url.Values, error) {
+	r, err := transport.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	hello, err := io.ReadAll(io.LimitReader(r, int64(*maxCommandSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(hello) > *maxCommandSize {
+		return nil, errors.New("tcp hello is too large")
+	}
+	return url.ParseQuery(string(hello))
+}
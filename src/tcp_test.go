@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialTCP starts a tcp listener on the hub and connects to it
+func dialTCP(tb testing.TB, hub *Hub) net.Conn {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go ServeTCP(hub, listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+		listener.Close()
+	})
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func tcpFrame(kind byte, payload []byte) []byte {
+	frame := binary.LittleEndian.AppendUint32([]byte{kind}, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// readTCPFrame reads the next frame, skipping the server's pings
+func readTCPFrame(tb testing.TB, reader *bufio.Reader) (byte, []byte) {
+	tb.Helper()
+	for {
+		header := make([]byte, tcpFrameHeaderSize)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			tb.Fatal(err)
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			tb.Fatal(err)
+		}
+		if header[0] != TCP_FRAME_PING {
+			return header[0], payload
+		}
+	}
+}
+
+func TestTCPFraming(t *testing.T) {
+	hub := startHub()
+	conn := dialTCP(t, hub)
+	reader := bufio.NewReader(conn)
+
+	conn.Write(tcpFrame(TCP_FRAME_MESSAGE, []byte("username=bob")))
+	if kind, connected := readTCPFrame(t, reader); kind != TCP_FRAME_MESSAGE || connected[0] != RES_ID_CONFIRMATION || connected[1] != CONF_CONNECTED {
+		t.Fatalf("expected the connected confirmation, got frame %v %q", kind, connected)
+	}
+
+	conn.Write(tcpFrame(TCP_FRAME_PING, []byte("ping")))
+	if kind, payload := readTCPFrame(t, reader); kind != TCP_FRAME_PONG || string(payload) != "ping" {
+		t.Fatalf("expected a pong with the ping's payload, got frame %v %q", kind, payload)
+	}
+
+	// Frames are found however the stream is cut up
+	command, _ := json.Marshal(map[string]any{"action": LIST_MATCHES})
+	frame := tcpFrame(TCP_FRAME_MESSAGE, append([]byte{CMD_PREFIX}, command...))
+	stream := append(frame, frame...)
+	for i := range stream {
+		if _, err := conn.Write(stream[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if kind, listed := readTCPFrame(t, reader); kind != TCP_FRAME_MESSAGE || listed[0] != RES_ID_COMMAND_RES {
+			t.Fatalf("expected the match list, got frame %v %q", kind, listed)
+		}
+	}
+
+	// A message frame over the limit ends the connection
+	conn.Write(binary.LittleEndian.AppendUint32([]byte{TCP_FRAME_MESSAGE}, uint32(*maxFrameSize+1)))
+	for {
+		header := make([]byte, tcpFrameHeaderSize)
+		_, err := io.ReadFull(reader, header)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected the connection to close, got %v", err)
+		}
+		io.CopyN(io.Discard, reader, int64(binary.LittleEndian.Uint32(header[1:])))
+	}
+}
+
+func TestTCPRefusal(t *testing.T) {
+	hub := startHub()
+	conn := dialTCP(t, hub)
+	reader := bufio.NewReader(conn)
+
+	conn.Write(tcpFrame(TCP_FRAME_MESSAGE, []byte("version=bad")))
+	if kind, reason := readTCPFrame(t, reader); kind != TCP_FRAME_CLOSE || string(reason) != `Malformed protocol version "bad"` {
+		t.Errorf("expected a close frame with the reason, got frame %v %q", kind, reason)
+	}
+}
@@ -0,0 +1,49 @@
+/** Ticking matches batch their relay packets, so each player gets one frame per tick instead of one per packet
+
+Batch:  RES_ID_BATCH | (length (uint32 LE) | packet)...
+
+Only clients that negotiated the batching capability get batches, the rest get each packet as it comes.
+Each packet in a batch is a RES_ID_RELAY_MSG packet exactly as it would have been sent alone, sender peer ID included, in the order it was relayed.
+A batch that grows past the largest relay packet is sent before the tick rather than waiting for it.
+Only plain relay packets to players are batched, reliable and latest-only packets, spectator traffic and server messages are sent as they come.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+)
+
+// SendRelay sends a relay packet to the client, or adds it to the client's batch when the match ticks
+func (m *Match) SendRelay(client *Client, packet []byte) {
+	if m.meta.TickRate == 0 || !client.batching {
+		if !client.SendUnreliable(packet) {
+			client.Send(packet)
+		}
+		return
+	}
+
+	batch := m.batches[client]
+	if batch == nil {
+		batch = []byte{RES_ID_BATCH}
+	}
+	batch = binary.LittleEndian.AppendUint32(batch, uint32(len(packet)))
+	batch = append(batch, packet...)
+	if len(batch) >= *maxRelaySize {
+		client.Send(batch)
+		delete(m.batches, client)
+		return
+	}
+	m.batches[client] = batch
+}
+
+// FlushBatches sends every waiting batch, called by the match goroutine on each tick
+func (m *Match) FlushBatches() {
+	for client, batch := range m.batches {
+		// Clients that left the match, or resumed on a new connection, since their batch started don't get it
+		if m.Client(client.guid.String()) == client {
+			client.Send(batch)
+		}
+	}
+	clear(m.batches)
+}
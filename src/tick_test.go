@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBatchesOnlyReachMembers(t *testing.T) {
+	hub := NewHub()
+	newClient := func() *Client {
+		client, err := NewClient("player", hub, newPipeTransport(), make(chan []byte, sendBufferSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.batching = true
+		return client
+	}
+	host := newClient()
+
+	tests := []struct {
+		name string
+		// What happens to the member between its packet being batched and the tick
+		change    func(match *Match, member *Client) *Client
+		delivered bool
+	}{
+		{"stays", func(match *Match, member *Client) *Client { return member }, true},
+		{"leaves", func(match *Match, member *Client) *Client {
+			match.RemoveClient(member)
+			return member
+		}, false},
+		{"resumes", func(match *Match, member *Client) *Client {
+			resumed := newClient()
+			resumed.guid = member.guid
+			match.ReplaceClient(resumed)
+			return resumed
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := NewMatch(MatchData{TickRate: 10}, host, defaultMaxClients)
+			member := newClient()
+			match.AddClients([]*Client{member})
+
+			match.SendRelay(member, []byte{RES_ID_RELAY_MSG})
+			member = test.change(match, member)
+			match.FlushBatches()
+			if delivered := len(member.send) > 0; delivered != test.delivered {
+				t.Errorf("batch delivered %v, want %v", delivered, test.delivered)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+/** Clock synchronization gives every peer the server's clock as a common timebase
+
+time_sync works like an NTP exchange. The client sends its own clock reading, which the server echoes back with two readings of its clock:
+- receive: when the client's read pump read the command
+- transmit: when the write pump wrote the response
+Every server time is in microseconds since the Unix epoch.
+
+With t3 the client's clock when the response arrives, the client estimates
+	offset = ((receive - client_time) + (transmit - t3)) / 2
+	delay  = (t3 - client_time) - (transmit - receive)
+and should keep the offset of the exchange with the lowest delay out of several.
+
+With -server-time-interval set, matches also send their members and spectators the server time on that interval:
+	RES_ID_SERVER_TIME | microseconds since the Unix epoch (int64 LE)
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// TimeSync carries the client's clock reading, which is echoed back untouched
+type TimeSync struct {
+	ClientTime Value `json:"client_time"`
+}
+
+type TimeSyncResponse struct {
+	ClientTime Value `json:"client_time"`
+	Receive    int64 `json:"receive"`
+	Transmit   int64 `json:"transmit"`
+}
+
+// timeSyncBufferSize is how many time_sync responses a client can have waiting on its write pump
+const timeSyncBufferSize = 8
+
+// HandleTimeSync hands the response to the client's write pump, which stamps the transmit time as it writes it
+func (h *Hub) HandleTimeSync(client *Client, message TimeSync, received time.Time) error {
+	response := TimeSyncResponse{ClientTime: message.ClientTime, Receive: received.UnixMicro()}
+	if response.ClientTime.Len() == 0 {
+		response.ClientTime = JSONValue([]byte("0"))
+	}
+	select {
+	case client.timeSyncs <- response:
+	case <-client.done:
+	}
+	return nil
+}
+
+// timeSyncPacket stamps the response with the transmit time, called by the write pump right before the write
+func (c *Client) timeSyncPacket(response TimeSyncResponse, transmit time.Time) ([]byte, error) {
+	response.Transmit = transmit.UnixMicro()
+	return NewNotification(response, RES_ID_TIME_SYNC).Encode(c.codec)
+}
+
+// SendServerTime tells every member and spectator of the match the server time, called by the match goroutine
+func (m *Match) SendServerTime(now time.Time) {
+	notify := binary.LittleEndian.AppendUint64([]byte{RES_ID_SERVER_TIME}, uint64(now.UnixMicro()))
+	for _, client := range m.Clients() {
+		client.Send(notify)
+	}
+	for _, spectator := range m.Spectators() {
+		spectator.Send(notify)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimeSyncStamps(t *testing.T) {
+	hub := startHub()
+	client := connect(t, hub, "username=client")
+
+	sent := time.Now().UnixMicro()
+	client.Command(map[string]any{"action": TIME_SYNC, "client_time": 42})
+	message := client.Expect(RES_ID_TIME_SYNC)
+	read := time.Now().UnixMicro()
+
+	var response TimeSyncResponse
+	if err := json.Unmarshal(message[1:], &response); err != nil {
+		t.Fatalf("could not read the response %q: %v", message, err)
+	}
+	if string(response.ClientTime.raw) != "42" {
+		t.Errorf("client time echoed as %s, want 42", response.ClientTime.raw)
+	}
+	if response.Receive < sent || response.Transmit < response.Receive || read < response.Transmit {
+		t.Errorf("stamps out of order: sent %v, receive %v, transmit %v, read %v", sent, response.Receive, response.Transmit, read)
+	}
+}
@@ -0,0 +1,96 @@
+/** Transports carry a client's messages, so the read and write pumps work the same over websockets and raw TCP
+
+Every transport moves whole messages with the same prefixes, and has pings whose payload comes back in a pong.
+*/
+
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"io"
+	"time"
+)
+
+type Transport interface {
+	// NextReader returns the next inbound message, which must be read to the end before the next call
+	NextReader() (io.Reader, error)
+	// WriteMessage sends one message whole
+	WriteMessage(message []byte) error
+	// Ping sends a ping, the pong handler gets its payload back
+	Ping(payload []byte) error
+	SetPongHandler(handler func(payload []byte))
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	// WriteClose tells the other side the server is closing the connection
+	WriteClose() error
+	Close() error
+}
+
+type websocketTransport struct {
+	conn *websocket.Conn
+	// The hijacked connection, used to measure what compressed messages cost on the wire
+	wire *countingConn
+	// Whether permessage-deflate was negotiated
+	compression bool
+}
+
+func NewWebsocketTransport(conn *websocket.Conn, wire *countingConn, compression bool) *websocketTransport {
+	conn.SetReadLimit(*maxFrameSize)
+	if compression {
+		conn.SetCompressionLevel(*compressionLevel)
+	}
+	return &websocketTransport{conn: conn, wire: wire, compression: compression}
+}
+
+func (t *websocketTransport) NextReader() (io.Reader, error) {
+	_, r, err := t.conn.NextReader()
+	return r, err
+}
+
+func (t *websocketTransport) WriteMessage(message []byte) error {
+	// Small relay packets aren't worth the cost of compressing
+	compress := t.compression && len(message) >= *compressionThreshold
+	t.conn.EnableWriteCompression(compress)
+	written := t.wire.written.Load()
+
+	w, err := t.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	w.Write(message)
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if compress {
+		recordCompression(len(message), t.wire.written.Load()-written)
+	}
+	return nil
+}
+
+func (t *websocketTransport) Ping(payload []byte) error {
+	return t.conn.WriteMessage(websocket.PingMessage, payload)
+}
+
+func (t *websocketTransport) SetPongHandler(handler func(payload []byte)) {
+	t.conn.SetPongHandler(func(payload string) error {
+		handler([]byte(payload))
+		return nil
+	})
+}
+
+func (t *websocketTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *websocketTransport) SetWriteDeadline(deadline time.Time) error {
+	return t.conn.SetWriteDeadline(deadline)
+}
+
+func (t *websocketTransport) WriteClose() error {
+	return t.conn.WriteMessage(websocket.CloseMessage, []byte{})
+}
+
+func (t *websocketTransport) Close() error {
+	return t.conn.Close()
+}
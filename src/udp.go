@@ -0,0 +1,138 @@
+/** UDP carries unreliable relay traffic for clients that want to avoid head-of-line blocking
+
+Started with -udp-addr. Each protocol version 2 client's connected confirmation then carries FEATURE_UDP and an 8 byte UDP token, which follows the resume token if there is one.
+The token ties datagrams to the client, so its websocket or TCP connection still carries commands and reliable packets.
+
+Datagram: UDP token (8) | message
+
+The message is a relay or latest-only relay message, exactly as it would be sent over the connection.
+A datagram holding just the token tells the server where to send to, and keeps NAT mappings open, so clients should send one as soon as they connect and then every few seconds.
+Once the server has heard from a client over UDP, relay and latest-only packets to it go over UDP too, unless they are too large for a datagram.
+Anything else in a datagram is dropped, as are datagrams for a match whose relay queue is full.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+const (
+	udpTokenSize = 8
+	// Larger packets go over the connection, to stay clear of IP fragmentation
+	maxDatagramSize = 1200
+)
+
+type UDPServer struct {
+	conn net.PacketConn
+
+	mu      sync.RWMutex
+	clients map[string]*Client // UDP token -> client
+}
+
+func NewUDPServer(conn net.PacketConn) *UDPServer {
+	return &UDPServer{conn: conn, clients: make(map[string]*Client)}
+}
+
+func NewUDPToken() string {
+	token := make([]byte, udpTokenSize)
+	rand.Read(token)
+	return string(token)
+}
+
+// Add lets the client send datagrams with its token, doing nothing when UDP is disabled
+func (s *UDPServer) Add(client *Client) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients[client.udpToken] = client
+}
+
+// Remove forgets the client's token, doing nothing when UDP is disabled
+func (s *UDPServer) Remove(client *Client) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clients[client.udpToken] == client {
+		delete(s.clients, client.udpToken)
+	}
+}
+
+func (s *UDPServer) client(token string) *Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.clients[token]
+}
+
+// Serve reads datagrams until the connection is closed
+func (s *UDPServer) Serve() error {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			log.Println("Could not read datagram: ", err)
+			continue
+		}
+		if n < udpTokenSize {
+			continue
+		}
+		client := s.client(string(buffer[:udpTokenSize]))
+		if client == nil {
+			continue
+		}
+		select {
+		case <-client.done:
+			continue
+		default:
+		}
+		// The address may change when a NAT rebinds, the token is what identifies the client
+		client.udpAddr.Store(&addr)
+
+		message := buffer[udpTokenSize:n]
+		if len(message) == 0 || (message[0] != RELAY_PREFIX && message[0] != LATEST_PREFIX) {
+			continue
+		}
+		if len(message)-1 > MessageLimit(message[0]) {
+			continue
+		}
+		if match := client.match.Load(); match != nil {
+			// One busy match mustn't hold up every other client's datagrams, so the packet is dropped like a lost datagram
+			// The buffer is reused for the next datagram
+			match.TryRelay(append([]byte(nil), message...), client)
+		}
+	}
+}
+
+// SendUnreliable sends a packet over UDP if the client has been heard from there, and over its connection otherwise
+// It returns false when the packet should go over the connection instead
+func (c *Client) SendUnreliable(packet []byte) bool {
+	addr := c.udpAddr.Load()
+	if addr == nil || len(packet) > maxDatagramSize {
+		return false
+	}
+	// Closed clients drop what they are sent, the same as over the connection
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	if _, err := c.hub.udp.conn.WriteTo(packet, *addr); err != nil {
+		log.Println("Could not send datagram: ", err)
+		return false
+	}
+	return true
+}
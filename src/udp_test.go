@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// Datagrams are held to the same size limits as messages over the connection
+func TestUDPSizeLimits(t *testing.T) {
+	setFlag(t, maxRelaySize, 64)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := startHub()
+	hub.udp = NewUDPServer(conn)
+	go hub.udp.Serve()
+	t.Cleanup(func() { conn.Close() })
+
+	host := connect(t, hub, "username=host&version=2")
+	peer := connect(t, hub, "username=peer&version=2")
+	hostAndJoin(t, host, peer)
+	token := peer.connected[len(peer.connected)-udpTokenSize:]
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	send := func(channel byte, size int) {
+		datagram := append([]byte(token), LATEST_PREFIX)
+		datagram = append(datagram, host.id...)
+		datagram = append(datagram, channel)
+		datagram = append(datagram, bytes.Repeat([]byte{'x'}, size-relayPeerIDSize-latestChannelSize)...)
+		if _, err := client.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One byte over the limit is dropped, the limit itself gets through
+	limit := MessageLimit(LATEST_PREFIX)
+	send(1, limit+1)
+	send(2, limit)
+
+	latest := host.Expect(RES_ID_LATEST_MSG)
+	if latest[1] != 2 || len(latest) != 2+limit-latestChannelSize {
+		t.Errorf("got channel %d, %d bytes", latest[1], len(latest))
+	}
+}
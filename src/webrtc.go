@@ -0,0 +1,125 @@
+/** The relay is the signaling server for players that upgrade to WebRTC once they are matched
+
+Every player gets a Godot multiplayer peer ID for as long as it is in the match: the host that created the match is 1, and everyone after gets the next ID up.
+Godot expects the host to be peer 1, so when the host leaves the new host gives up its ID and takes 1, and every member gets RES_ID_PEER_REMAP after the host's disconnection.
+Other IDs aren't reused, and peer IDs are sent with peer notifications and get_peer_stats.
+
+Players pass SDP offers and answers and ICE candidates to each other with the signal command, addressed by peer ID or UUID.
+The target gets them as RES_ID_SIGNAL with the sender's peer ID and UUID, and signals only ever go between players of the same match.
+Players whose connection fails keep relaying through the server as before.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"log"
+)
+
+const (
+	SIGNAL_OFFER     = "offer"
+	SIGNAL_ANSWER    = "answer"
+	SIGNAL_CANDIDATE = "candidate"
+)
+
+// Signal is one step of setting up a WebRTC connection, the fields used depend on the type
+type Signal struct {
+	// The target, by Godot peer ID or by UUID
+	PeerID int32  `json:"peer_id"`
+	UUID   string `json:"uuid"`
+	Type   string `json:"type"`
+	// Offers and answers
+	SDP string `json:"sdp,omitempty"`
+	// Candidates, the arguments of WebRTCPeerConnection.add_ice_candidate
+	Media string `json:"media,omitempty"`
+	Index int    `json:"index,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+// ForwardedSignal is what the target receives
+type ForwardedSignal struct {
+	From   string `json:"from"`
+	PeerID int32  `json:"peer_id"`
+	Type   string `json:"type"`
+	SDP    string `json:"sdp,omitempty"`
+	Media  string `json:"media,omitempty"`
+	Index  int    `json:"index"`
+	Name   string `json:"name,omitempty"`
+}
+
+// PeerRemap tells the members of a match that a player's peer ID changed
+type PeerRemap struct {
+	UUID   string `json:"uuid"`
+	From   int32  `json:"from"`
+	PeerID int32  `json:"peer_id"`
+}
+
+// PromoteHost gives the new host of the match peer ID 1, returning the ID it had
+func (m *Match) PromoteHost(client *Client) int32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.peerIDs[client.guid.String()]
+	m.peerIDs[client.guid.String()] = TARGET_PEER_HOST
+	return previous
+}
+
+// PeerID returns the Godot peer ID of a player, 0 if the client isn't a player of the match or the match is nil
+func (m *Match) PeerID(client *Client) int32 {
+	if m == nil {
+		return 0
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.peerIDs[client.guid.String()]
+}
+
+// ClientByPeerID looks up a player by Godot peer ID, returns nil if no player has it
+func (m *Match) ClientByPeerID(peerID int32) *Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for guid, id := range m.peerIDs {
+		if id == peerID {
+			return m.clients[guid]
+		}
+	}
+	return nil
+}
+
+func (h *Hub) HandleSignal(client *Client, message Signal) error {
+	log.Println("Signal requested...")
+
+	match := h.matchByClient[client]
+	if match == nil || match.Client(client.guid.String()) == nil {
+		client.SendError(ERR_SIGNAL_REJECTED, "Only players in a match can signal")
+		return nil
+	}
+	if message.Type != SIGNAL_OFFER && message.Type != SIGNAL_ANSWER && message.Type != SIGNAL_CANDIDATE {
+		client.SendError(ERR_SIGNAL_REJECTED, "Signal type must be offer, answer or candidate")
+		return nil
+	}
+
+	var target *Client
+	if message.PeerID != 0 {
+		target = match.ClientByPeerID(message.PeerID)
+	} else if uid, err := DecodeUUID(message.UUID); err == nil {
+		target = match.Client(uid.String())
+	}
+	if target == nil || target == client {
+		client.SendError(ERR_SIGNAL_REJECTED, "Signal target is not another player in this match")
+		return nil
+	}
+
+	target.Notify(NewNotification(ForwardedSignal{
+		From:   base64.StdEncoding.EncodeToString(client.guid[:]),
+		PeerID: match.PeerID(client),
+		Type:   message.Type,
+		SDP:    message.SDP,
+		Media:  message.Media,
+		Index:  message.Index,
+		Name:   message.Name,
+	}, RES_ID_SIGNAL))
+	return nil
+}
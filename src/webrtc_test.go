@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewHostTakesPeerIDOne(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	first := connect(t, hub, "username=first")
+	second := connect(t, hub, "username=second")
+	hostAndJoin(t, host, first, second)
+	first.Expect(RES_ID_PEER_CONNECTED)
+	first.Expect(RES_ID_PEER_CONNECTED)
+	second.Expect(RES_ID_PEER_CONNECTED)
+
+	host.transport.Close()
+	second.Expect(RES_ID_PEER_DISCONNECTED)
+	var remap PeerRemap
+	if err := json.Unmarshal(second.Expect(RES_ID_PEER_REMAP)[1:], &remap); err != nil {
+		t.Fatal(err)
+	}
+	if remap.PeerID != TARGET_PEER_HOST || remap.From < 2 {
+		t.Fatalf("remapped %+v", remap)
+	}
+
+	// Signals for peer 1 now go to the new host, and come from peer 1
+	newHost, other := first, second
+	if remap.UUID != first.id {
+		newHost, other = second, first
+	}
+	other.Command(map[string]any{"action": SIGNAL, "peer_id": TARGET_PEER_HOST, "type": SIGNAL_OFFER, "sdp": "offer"})
+	var offer ForwardedSignal
+	if err := json.Unmarshal(newHost.Expect(RES_ID_SIGNAL)[1:], &offer); err != nil {
+		t.Fatal(err)
+	}
+	newHost.Command(map[string]any{"action": SIGNAL, "uuid": offer.From, "type": SIGNAL_ANSWER, "sdp": "answer"})
+	var answer ForwardedSignal
+	if err := json.Unmarshal(other.Expect(RES_ID_SIGNAL)[1:], &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.PeerID != TARGET_PEER_HOST {
+		t.Errorf("answer came from peer %v", answer.PeerID)
+	}
+}
+
+func TestSignalsStayInTheMatch(t *testing.T) {
+	hub := startHub()
+	host := connect(t, hub, "username=host")
+	peer := connect(t, hub, "username=peer")
+	watcher := connect(t, hub, "username=watcher")
+	lobby := connect(t, hub, "username=lobby")
+	otherHost := connect(t, hub, "username=other_host")
+	otherPeer := connect(t, hub, "username=other_peer")
+	match := hostAndJoin(t, host, peer)
+	hostAndJoin(t, otherHost, otherPeer)
+	watcher.Command(map[string]any{"action": SPECTATE_MATCH, "uuid": match})
+	watcher.Expect(RES_ID_CONFIRMATION)
+
+	tests := []struct {
+		name   string
+		sender *testClient
+		target string
+		want   string
+	}{
+		{"outside a match", lobby, host.id, "Only players in a match can signal"},
+		{"spectator", watcher, host.id, "Only players in a match can signal"},
+		{"player in another match", peer, otherPeer.id, "Signal target is not another player in this match"},
+		{"itself", peer, peer.id, "Signal target is not another player in this match"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.sender.Command(map[string]any{"action": SIGNAL, "uuid": test.target, "type": SIGNAL_OFFER, "sdp": "offer"})
+			if rejected := test.sender.Expect(RES_ID_ERROR); rejected[1] != ERR_SIGNAL_REJECTED || string(rejected[2:]) != test.want {
+				t.Errorf("got %q, want %q", rejected, test.want)
+			}
+		})
+	}
+
+	// The first signal the other match's peer gets is from its own host
+	otherHost.Command(map[string]any{"action": SIGNAL, "uuid": otherPeer.id, "type": SIGNAL_OFFER, "sdp": "offer"})
+	var signal ForwardedSignal
+	if err := json.Unmarshal(otherPeer.Expect(RES_ID_SIGNAL)[1:], &signal); err != nil {
+		t.Fatal(err)
+	}
+	if signal.From != otherHost.id {
+		t.Errorf("got a signal from %q, want only the ones from %q", signal.From, otherHost.id)
+	}
+}